@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply {topology file}",
+	Short: "Make bcache devices on this host match a topology file",
+	Long: `Read a yaml topology file describing cache devices, backing devices, which cache each backing device is attached to, labels and tunables. The current devices are compared against it and only the missing steps (format, register, attach, label, tune) are executed, so running it again is safe. Use --plan to only print the steps.
+
+Example topology file:
+
+tunables:
+  sequential_cutoff: 4M
+caches:
+  - name: ssd0
+    device: /dev/nvme0n1p1
+backing:
+  - device: /dev/sdb
+    cache: ssd0
+    label: osd-0
+    tunables:
+      cache_mode: writeback
+  - device: /dev/sdc
+    cache: ssd0
+    wipe: true`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			t, err := bcache.LoadTopology(args[0])
+			if err != nil {
+				fmt.Println("Error reading topology file: " + err.Error())
+				exit(1)
+			}
+			all, err := bcache.AllDevs()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			steps, err := all.PlanTopology(t)
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			apply(steps, PlanOnly)
+		}
+	},
+}
+
+func apply(steps []bcache.Step, planOnly bool) {
+	if len(steps) == 0 {
+		fmt.Println("Devices already match the topology, nothing to do.")
+		return
+	}
+	if planOnly {
+		fmt.Println("Planned steps:")
+		for i, step := range steps {
+			fmt.Printf("%3d. %s\n", i+1, step.Description)
+		}
+		return
+	}
+	for i, step := range steps {
+		fmt.Printf("%3d. %s\n", i+1, step.Description)
+		if err := step.Do(); err != nil {
+			fmt.Println("Step failed: " + err.Error())
+			exit(1)
+		}
+	}
+	fmt.Println("Topology applied.")
+}
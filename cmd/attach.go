@@ -1,27 +1,31 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var attachCmd = &cobra.Command{
-	Use:   "attach {cache device} {backing device}",
+	Use:   "attach {cache device} {backing device} | {cache device} --to {dev1,dev2,...}|--label {glob}|--all-unattached",
 	Short: "Attach an already formatted bcache cache device to a backing device",
-	Long:  "Attaches a device that has already been formatted as a cache device (exists in sysfs and has uuid) to an already formatted backing device.",
-	Args:  cobra.ExactArgs(2),
+	Long:  "Attaches a device that has already been formatted as a cache device (exists in sysfs and has uuid) to an already formatted backing device. With --to, --label or --all-unattached the cache device is attached to many backing devices concurrently, devices already attached to it are left alone.",
+	Args:  bulkArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		all, err := bcache.AllDevs()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		if len(args) == 1 {
+			bulkAttach(all, args[0])
+			return
 		}
 		x, b := all.IsBDevice(args[1])
 		if !x {
 			fmt.Println(args[1] + " is not a bcache device.")
-			os.Exit(1)
+			exit(1)
 		}
 		if b.CacheDev != bcache.NONE_ATTACHED {
 			fmt.Println(args[1] + " (" + b.ShortName + ") already has cache attached (" + b.CacheDev + ")")
@@ -29,10 +33,58 @@ var attachCmd = &cobra.Command{
 			err := all.Attach(args[0], args[1])
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(1)
+				exit(1)
 			} else {
 				fmt.Println("Cache device", args[0], "was attached as cache for", b.BackingDev+" ("+b.ShortName+")")
 			}
 		}
 	},
 }
+
+// attach and detach take one backing device or a bulk selection
+func bulkArgs(cmd *cobra.Command, args []string) error {
+	if len(BulkDevices) > 0 || BulkLabel != "" || BulkAll {
+		if len(args) != 1 {
+			return errors.New("I need only the cache device when backing devices are selected with flags")
+		}
+		return nil
+	}
+	return cobra.ExactArgs(2)(cmd, args)
+}
+
+func bulkAttach(all *bcache.BcacheDevs, cdev string) {
+	bdevs, err := all.SelectBdevs(BulkDevices, BulkLabel, func(b *bcache.Bcache_bdev) bool {
+		return BulkAll && b.CUUID == bcache.NONE_ATTACHED
+	})
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	results, err := all.BulkAttach(cdev, bdevs)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	if printBulkResults("attached to "+cdev, results) > 0 {
+		exit(1)
+	}
+}
+
+// Print the devices that changed or failed and a summary line, returns the number of failures
+func printBulkResults(what string, results []bcache.BulkResult) (failed int) {
+	changed, unchanged := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+			fmt.Println("FAILED " + r.BackingDev + " (" + r.Device + "): " + r.Err.Error())
+		case r.Changed:
+			changed++
+			fmt.Println(r.BackingDev + " (" + r.Device + ") " + what)
+		default:
+			unchanged++
+		}
+	}
+	fmt.Printf("%d changed, %d unchanged, %d failed\n", changed, unchanged, failed)
+	return
+}
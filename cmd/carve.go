@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"strconv"
+	"strings"
+)
+
+var carveCmd = &cobra.Command{
+	Use:   "carve --cache-device {device} --for {dev1,dev2,...}",
+	Short: "Partition a cache device into one cache partition per backing device",
+	Long: `Create one GPT partition on the cache device for each backing device, labelled '<backing>_cache' (eg. sdb_cache). Partitions that already exist with the right label are reused, so running it again is safe.
+
+--wipe-table replaces the partition table of the cache device, which is refused while one of its partitions is a registered bcache device or the disk or a partition is in use.
+
+Sizing of new partitions:
+  equal         share the largest free region of the cache device equally (default)
+  proportional  share the largest free region in proportion to the backing device sizes
+  fixed         give each partition --size bytes (implied when --size is used)
+
+With --format each partition is formatted and registered as a cache device, --attach additionally attaches each one to its (already registered) backing device.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			if CarveDev == "" || CarveFor == "" {
+				fmt.Println("I need a cache device (--cache-device) and backing devices to carve for (--for)")
+				exit(1)
+			}
+			sizing := CarveSizing
+			var size uint64
+			if CarveSize != "" {
+				if cmd.Flags().Changed("sizing") && sizing != bcache.SIZING_FIXED {
+					fmt.Println("--size can only be used with fixed sizing")
+					exit(1)
+				}
+				sizing = bcache.SIZING_FIXED
+				var err error
+				if size, err = strconv.ParseUint(bcache.HumanToBytes(CarveSize), 10, 64); err != nil || size == 0 {
+					fmt.Println("invalid size " + CarveSize)
+					exit(1)
+				}
+			}
+			all, err := bcache.AllDevs()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			if x, _ := all.IsCDevice(CarveDev); x {
+				fmt.Println(CarveDev + " is a registered cache device and can't be partitioned.")
+				exit(1)
+			}
+			if CarveWipeTable {
+				if err = all.CheckNotRegistered(CarveDev); err != nil {
+					fmt.Println(err)
+					exit(1)
+				}
+				refuseInUse(Force, bcache.CheckNotInUse(CarveDev))
+			}
+			var backing []string
+			for _, dev := range strings.Split(CarveFor, ",") {
+				if !strings.HasPrefix(dev, "/") {
+					dev = "/dev/" + dev
+				}
+				backing = append(backing, dev)
+			}
+			carve(CarveDev, backing, sizing, size)
+		}
+	},
+}
+
+func carve(cacheDev string, backing []string, sizing string, size uint64) {
+	t, parts, err := bcache.PlanCarve(cacheDev, backing, sizing, size, CarveWipeTable)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	for _, j := range []string{"Backing", "Partition", "Label", "Size", "Status"} {
+		printColumn("[" + j + "]")
+	}
+	fmt.Printf("\n")
+	for _, p := range parts {
+		status := "new"
+		if p.Existing {
+			status = "existing"
+		}
+		for _, j := range []string{p.Backing, p.Device, p.Label, bcache.BytesToHuman(p.Size), status} {
+			printColumn(j)
+		}
+		fmt.Printf("\n")
+	}
+	if PlanOnly {
+		return
+	}
+	if CarveFormat || CarveAttach {
+		// reused partitions are formatted unless they already carry a bcache superblock
+		var inUse []error
+		for _, p := range parts {
+			if p.Existing && !bcache.IsFormatted(p.Device) {
+				inUse = append(inUse, bcache.CheckNotInUse(p.Device))
+			}
+		}
+		refuseInUse(Force, inUse...)
+	}
+	if err = bcache.Carve(t, parts); err != nil {
+		fmt.Println("Error writing partitions: " + err.Error())
+		exit(1)
+	}
+	if !CarveFormat && !CarveAttach {
+		return
+	}
+	var overallErr error
+	for _, p := range parts {
+		err = p.MakeCache(CarveAttach, CarveWipe)
+		if err != nil {
+			fmt.Println(p.Device + ": " + err.Error())
+			overallErr = err
+		} else if CarveAttach {
+			fmt.Println(p.Device, "is registered as cache for", p.Backing)
+		} else {
+			fmt.Println(p.Device, "is registered as a cache device")
+		}
+	}
+	if overallErr != nil {
+		exit(1)
+	}
+}
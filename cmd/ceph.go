@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/rafalop/bcachectl/pkg/ceph"
+	"github.com/spf13/cobra"
+)
+
+var cephCmd = &cobra.Command{
+	Use:   "ceph",
+	Short: "Ceph OSD helpers",
+}
+
+var cephPrepareCmd = &cobra.Command{
+	Use:   "prepare --data-devices {dev1,dev2,...} [--cache-device {disk} --cache-size {size}] [--db-device {disk} --db-size {size}] [--wal-device {disk} --wal-size {size}]",
+	Short: "Prepare one or more Ceph OSDs on bcache devices",
+	Long: `Prepare one or more Ceph OSDs, each data device becomes a bcache backing device with a cache partition on --cache-device. Optionally db and wal partitions are created on --db-device and --wal-device. Partitions are labelled after the data device (eg. sdb_cache, sdb_db, sdb_wal). Finally the OSD is created with 'ceph-volume lvm create'.
+
+Nothing is changed unless --doit is given, without it only the planned steps are printed. With --dry-run the steps are run but their changes are only printed.
+
+Examples:
+bcachectl ceph prepare --data-devices /dev/sdb --cache-device /dev/sdd --cache-size 30G
+bcachectl ceph prepare --data-devices /dev/sdb --cache-device /dev/sdd --cache-size 30G --db-device /dev/sdd --db-size 30G
+bcachectl ceph prepare --data-devices /dev/sdb,/dev/sdc,/dev/sdd --cache-device /dev/nvme0n1 --cache-size 100G --db-device /dev/nvme0n1 --db-size 30G --doit`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			p := ceph.NewPreparer(CephPrepare, ceph.CephVolume{})
+			steps, err := p.Plan()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			cephPrepare(steps, CephDoit || DryRun)
+		}
+	},
+}
+
+func cephPrepare(steps []bcache.Step, doit bool) {
+	for i, step := range steps {
+		fmt.Printf("%3d. %s\n", i+1, step.Description)
+		if !doit {
+			continue
+		}
+		if err := step.Do(); err != nil {
+			fmt.Println("Step failed: " + err.Error())
+			exit(1)
+		}
+	}
+	if !doit {
+		fmt.Println("\n--doit was not used, nothing was changed.")
+	} else if DryRun {
+		fmt.Println("\nDry run, nothing was changed.")
+	} else {
+		fmt.Println("OSD(s) prepared.")
+	}
+}
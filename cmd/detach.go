@@ -1,37 +1,94 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var detachCmd = &cobra.Command{
-	Use:   "detach {cache device} {backing device}",
+	Use:   "detach {cache device} {backing device} | {cache device} --from {dev1,dev2,...}|--label {glob}|--all",
 	Short: "Detaches cache (device) from a backing device",
-	Args:  cobra.ExactArgs(2),
+	Long:  "Detaches a cache device from a backing device and waits until the device reports 'no cache'. A device with dirty data is refused unless --flush (flush first, see 'bcachectl flush --help' for strategies) or --force (detach anyway, the kernel writes back the dirty data before the detach completes) is used. Devices in use (mounted, swap, held by LVM, dm-crypt or md) are refused unless --force-in-use is used. With --from, --label or --all (every device attached to the cache device) many backing devices are detached concurrently.",
+	Args:  bulkArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		all, err := bcache.AllDevs()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		if len(args) == 1 {
+			bulkDetach(all, args[0])
+			return
 		}
 		x, b := all.IsBDevice(args[1])
 		if !x {
 			fmt.Println(args[1] + " is not a bcache device.")
-			os.Exit(1)
+			exit(1)
 		}
 		if b.CacheDev == bcache.NONE_ATTACHED {
 			fmt.Println("device " + args[1] + " has no cache attached, nothing to do.")
 		} else {
-			err := all.Detach(args[0], args[1])
+			refuseInUseFlag(DetachInUse, "--force-in-use", bcache.CheckNotInUse(b.ShortName))
+			opts := bcache.NewFlushOptions()
+			opts.Strategy = FlushStrategy
+			opts.Timeout = FlushTimeout
+			progressed := false
+			opts.Progress = func(p bcache.FlushProgress) {
+				fmt.Printf("\r%-78s", formatProgress(p))
+				progressed = true
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			defer stop()
+			err := all.SafeDetach(ctx, args[0], args[1], DetachFlush, DetachForce, opts)
+			if progressed {
+				fmt.Println()
+			}
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(1)
+				exit(1)
 			} else {
 				fmt.Println("Detached cache dev", args[0], "from", b.BackingDev+" ("+b.ShortName+")")
 			}
 		}
 	},
 }
+
+func bulkDetach(all *bcache.BcacheDevs, cdev string) {
+	x, c := all.IsCDevice(cdev)
+	if !x {
+		fmt.Println(cdev + " is not a registered cache device.")
+		exit(1)
+	}
+	bdevs, err := all.SelectBdevs(BulkDevices, BulkLabel, func(b *bcache.Bcache_bdev) bool {
+		return BulkAll && b.CUUID == c.UUID
+	})
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	var inUse []error
+	for _, b := range bdevs {
+		if b.CUUID == c.UUID {
+			inUse = append(inUse, bcache.CheckNotInUse(b.ShortName))
+		}
+	}
+	refuseInUseFlag(DetachInUse, "--force-in-use", inUse...)
+	opts := bcache.NewFlushOptions()
+	opts.Strategy = FlushStrategy
+	opts.Timeout = FlushTimeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	results, err := all.BulkDetach(ctx, cdev, bdevs, DetachFlush, DetachForce, opts)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	if printBulkResults("detached from "+cdev, results) > 0 {
+		exit(1)
+	}
+}
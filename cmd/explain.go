@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain [tunable]",
+	Short: "Describe a tunable: sysfs path, scope, type, allowed values and default",
+	Long:  "Describe a tunable. Allowed values of enum tunables are read from sysfs when a device the tunable applies to is registered. Without a tunable, all known tunables are listed.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			for _, t := range bcache.TUNABLE_REGISTRY {
+				fmt.Printf("%-34s%-14s%s\n", t.Name, t.Scope, t.Description)
+			}
+			return
+		}
+		t, found := bcache.LookupTunable(args[0])
+		if !found {
+			fmt.Println("Unknown tunable: " + args[0] + "\n\nKnown tunables:")
+			printTunables()
+			exit(1)
+		}
+		all, err := bcache.AllDevs()
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		explain(t, t.FirstPath(all))
+	},
+}
+
+func explain(t bcache.Tunable, livePath string) {
+	fmt.Printf("%-20s%s\n", "Name:", t.Name)
+	fmt.Printf("%-20s%s\n", "Scope:", t.Scope)
+	fmt.Printf("%-20s%s\n", "Sysfs path:", t.SysfsPath())
+	fmt.Printf("%-20s%s\n", "Type:", t.Type)
+	if t.Unit != "" {
+		fmt.Printf("%-20s%s\n", "Unit:", t.Unit)
+	}
+	if t.ReadOnly {
+		fmt.Printf("%-20s%s\n", "Allowed:", "read-only, set by the kernel")
+	} else {
+		fmt.Printf("%-20s%s\n", "Allowed:", t.Range(livePath))
+	}
+	fmt.Printf("%-20s%s\n", "Kernel default:", t.Default)
+	if livePath != "" {
+		fmt.Printf("%-20s%s (%s)\n", "Current:", bcache.ReadSysfs(livePath), livePath)
+	}
+	fmt.Printf("%-20s%s\n", "Description:", t.Description)
+}
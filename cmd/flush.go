@@ -1,30 +1,82 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var flushCmd = &cobra.Command{
 	Use:   "flush {bcacheN}|all",
 	Short: "Flush devices dirty data from cache",
-	Long:  "Flush the dirty data for one or all bcache devices. Only used when cache is in writeback mode.",
-	Args:  cobra.ExactArgs(1),
+	Long: "Flush the dirty data for one or all bcache devices. Strategies are:\n" +
+		"  writethrough  switch to writethrough until clean (default)\n" +
+		"  drain         stay in writeback, set writeback_percent to 0 and raise writeback_rate_minimum\n" +
+		"  writearound   switch to writearound until clean, writes bypass the cache\n\n" +
+		"The changed settings are restored afterwards, also on Ctrl-C. They are recorded in " + bcache.FLUSH_JOURNAL_DIR + " first, use 'flush --recover' to restore them after an interrupted flush.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if FlushRecover {
+			return cobra.NoArgs(cmd, args)
+		}
+		if ApplyToAll {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
 		if IsAdmin {
-			err = Flush(args[0])
+			if FlushRecover {
+				err = flushRecover()
+			} else {
+				device := "all"
+				if len(args) == 1 {
+					device = args[0]
+				}
+				err = Flush(device)
+			}
 			if err != nil {
 				fmt.Println("Error flushing: " + err.Error())
-				os.Exit(1)
+				exit(1)
 			}
 		}
 	},
 }
 
+func flushRecover() error {
+	b, err := bcache.AllDevs()
+	if err != nil {
+		return errors.New("Error getting bcache devices:" + err.Error())
+	}
+	recovered, err := b.RecoverFlushes()
+	for _, dev := range recovered {
+		fmt.Println("restored settings of " + dev)
+	}
+	if err == nil && len(recovered) == 0 {
+		fmt.Println("no interrupted flushes to recover")
+	}
+	return err
+}
+
+// Progress line of a device, eg. "bcache0: 1.2G dirty, 85.3M/s, ETA 14s"
+func formatProgress(p bcache.FlushProgress) string {
+	line := fmt.Sprintf("%s: %s dirty", p.Device, bcache.BytesToHuman(p.Dirty))
+	if p.Rate > 0 {
+		line += fmt.Sprintf(", %s/s, ETA %s", bcache.BytesToHuman(uint64(p.Rate)), p.ETA.Round(time.Second))
+	} else {
+		line += ", rate unknown"
+	}
+	return line + fmt.Sprintf(" (%s elapsed)", p.Elapsed.Round(time.Second))
+}
+
 func Flush(device string) (returnErr error) {
 	var x bool
 	var y bcache.Bcache_bdev
@@ -32,39 +84,74 @@ func Flush(device string) (returnErr error) {
 	if err != nil {
 		return errors.New("Error getting bcache devices:" + err.Error())
 	}
+	opts := bcache.NewFlushOptions()
+	opts.Strategy = FlushStrategy
+	opts.Timeout = FlushTimeout
+	opts.DrainRate = FlushDrainRate
+	// restore the original settings on ctrl-c or kill
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+
 	if device == "" {
 		return errors.New("no device supplied")
-	} else if x, y = b.IsBDevice(device); device != "" && !x {
-		return errors.New(device + " is not a valid bcache device")
 	} else if device != "all" {
+		if x, y = b.IsBDevice(device); !x {
+			return errors.New(device + " is not a valid bcache device")
+		}
 		// Flush single
-		e1, e2 := y.FlushCache()
-		if e1 != nil {
+		progressed := false
+		opts.Progress = func(p bcache.FlushProgress) {
+			fmt.Printf("\r%-78s", formatProgress(p))
+			progressed = true
+		}
+		e1, e2 := y.Flush(ctx, opts)
+		if progressed {
+			fmt.Println()
+		}
+		if e1 != nil && e2 != nil {
+			returnErr = errors.New("errors during flush: " + y.ShortName + ": " + e1.Error() + ", " + e2.Error())
+		} else if e1 != nil {
 			returnErr = errors.New("could not flush " + y.ShortName + ": " + e1.Error())
 		} else if e2 != nil {
-			returnErr = errors.New("could reset writeback settings" + y.ShortName + ": " + e2.Error())
-		} else if e1 != nil && e2 != nil {
-			returnErr = errors.New("errors during flush: " + y.ShortName + ": " + e1.Error() + ", " + e2.Error())
+			returnErr = errors.New("could not reset settings of " + y.ShortName + ": " + e2.Error() + " (run 'bcachectl flush --recover' to retry)")
 		} else {
 			fmt.Println("cache for " + y.ShortName + " was flushed successfully.")
 		}
-	} else if device == "all" {
-		// Flush all
+	} else {
+		// Flush all, progress of each device is printed every 10 seconds
+		var mu sync.Mutex
+		printed := make(map[string]time.Time)
+		opts.Progress = func(p bcache.FlushProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			if time.Since(printed[p.Device]) >= 10*time.Second {
+				fmt.Println(formatProgress(p))
+				printed[p.Device] = time.Now()
+			}
+		}
 		c := make(chan string, len(b.Bdevs))
 		for _, dev := range b.Bdevs {
 			go func(d bcache.Bcache_bdev) {
-				var e1, e2 error
-				e1, e2 = d.FlushCache()
-				if e1 != nil || e2 != nil {
-					c <- "error while flushing " + d.ShortName + ": err1:" + e1.Error() + "err2:" + e2.Error() + "\n"
+				var errs []string
+				e1, e2 := d.Flush(ctx, opts)
+				if e1 != nil {
+					errs = append(errs, e1.Error())
+				}
+				if e2 != nil {
+					errs = append(errs, "could not reset settings: "+e2.Error())
+				}
+				if len(errs) > 0 {
+					c <- "error while flushing " + d.ShortName + ": " + strings.Join(errs, ", ")
+					mu.Lock()
 					returnErr = errors.New("couldn't flush one or more devices.")
+					mu.Unlock()
 				} else {
 					c <- "cache for " + d.ShortName + " was flushed successfully."
 				}
 			}(dev)
 		}
 		for range b.Bdevs {
-			fmt.Printf(<-c)
+			fmt.Println(<-c)
 		}
 	}
 	return
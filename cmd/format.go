@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var formatCmd = &cobra.Command{
@@ -16,14 +15,21 @@ var formatCmd = &cobra.Command{
 			all, err := bcache.AllDevs()
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(1)
+				exit(1)
 			}
+			var inUse []error
+			for _, dev := range []string{NewBDev, NewCDev} {
+				if dev != "" {
+					inUse = append(inUse, all.InUse(dev))
+				}
+			}
+			refuseInUse(Force, inUse...)
 			err = all.Format(NewBDev, NewCDev, Wipe, WriteBack)
 			if err == nil {
 				fmt.Println("Completed formatting device(s):", NewBDev, NewCDev)
 			} else {
 				fmt.Println(err)
-				os.Exit(1)
+				exit(1)
 			}
 		} else {
 			fmt.Println("I need at least one backing dev (-B) or one cache dev (-C) to format!")
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Print the bcache topology as a Graphviz or Mermaid graph",
+	Long:  "Print cache sets, cache devices, bcache devices and backing devices as a graph, annotated with cache mode, state, dirty data and capacity. Render dot output with eg. 'bcachectl graph | dot -Tsvg > bcache.svg', mermaid output can be pasted into markdown.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := bcache.AllDevs()
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		out, err := all.Graph(GraphFormat)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		fmt.Print(out)
+	},
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history [device]",
+	Short: "Show changes made by bcachectl, optionally only for one device",
+	Long:  "Show the audit log of changes made by bcachectl (sysfs writes and formatting), with time, uid, command line, device, attribute and old and new values. A bcache device, backing device, cache device or cache set uuid can be given to only show its changes.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := bcache.ReadAuditLog(AuditFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Println("No changes recorded in", AuditFile)
+				return
+			}
+			fmt.Println(err)
+			exit(1)
+		}
+		if len(args) == 1 {
+			all, err := bcache.AllDevs()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			entries = filterHistory(entries, deviceAliases(all, args[0]))
+		}
+		printHistory(entries, HistoryFormat)
+	},
+}
+
+// All names a device may have been recorded under
+func deviceAliases(b *bcache.BcacheDevs, device string) map[string]bool {
+	aliases := map[string]bool{device: true, filepath.Base(device): true}
+	if x, y := b.IsBDevice(device); x {
+		for _, a := range []string{y.ShortName, y.BcacheDev, y.BackingDev} {
+			aliases[a] = true
+		}
+	} else if x, z := b.IsCDevice(device); x {
+		aliases[z.Dev] = true
+		aliases[z.UUID] = true
+	}
+	return aliases
+}
+
+func filterHistory(entries []bcache.AuditEntry, aliases map[string]bool) (filtered []bcache.AuditEntry) {
+	for _, e := range entries {
+		if aliases[e.Device] {
+			filtered = append(filtered, e)
+			continue
+		}
+		// commands may name several devices
+		for _, d := range strings.Split(e.Device, ",") {
+			if aliases[d] {
+				filtered = append(filtered, e)
+				break
+			}
+		}
+	}
+	return
+}
+
+func printHistory(entries []bcache.AuditEntry, format string) {
+	if format == "json" {
+		json_out, _ := json.Marshal(entries)
+		fmt.Println(string(json_out))
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No changes found.")
+		return
+	}
+	for _, e := range entries {
+		change := e.Attribute + ": " + e.Old + " -> " + e.New
+		if e.Command != "" {
+			change = "ran: " + e.Command
+		} else if e.Old == "" {
+			change = e.Attribute + ": " + e.New
+		}
+		if e.Error != "" {
+			change += " (failed: " + e.Error + ")"
+		}
+		fmt.Printf("%-26s %-14s %s\n", e.Time.Format("2006-01-02 15:04:05 MST"), e.Device, change)
+		fmt.Printf("%-26s %s\n", "", e.Who())
+		fmt.Printf("%-26s %s\n", "", e.CmdLine)
+	}
+}
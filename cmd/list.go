@@ -1,11 +1,9 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 	"strings"
 )
 
@@ -14,63 +12,94 @@ var listCmd = &cobra.Command{
 	Short: "list all bcache devices",
 	Long: `list all bcache devices along with some info about them. 
 
-possible columns to output with -e:
-sequential_cutoff
+possible columns to output with -e (added to the default columns) or --columns (instead of them):
+BcacheDev, ShortName, BackingDev, CacheDev, BcacheDevUUID, CacheSetUUID, Label
+state
 dirty_data
 cache_hit_ratio
 cache_hits
 cache_misses
-writeback_percent`,
+cache_bypass_hits
+cache_bypass_misses
+bypassed
+congested
+or the name of any tunable (see 'bcachectl explain'), including cache set tunables
+any other attribute of the device, eg. stats_hour/cache_hit_ratio or stats_five_minute/bypassed
+any cache set attribute prefixed with 'set.', eg. set.cache_available_percent
+
+Sizes are shown with one decimal (eg. 1.2G). --filter keeps devices matching all of its comma
+separated conditions, eg. --filter 'state=dirty,cache_mode=writeback' or --filter 'dirty_data>1G'
+(operators = != > < >= <=, sizes and numbers are compared numerically). --sort orders the devices
+by any column, --reverse puts the largest first.
+
+-f csv prints the same columns as the table, -f template='{{.ShortName}} {{.Parameters.dirty_data}}'
+is executed for every device.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		all, err := bcache.AllDevs()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		filters, err := bcache.ParseFilters(ListFilter)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
 		}
-		listDevs(all, Format, Extra)
+		all.FilterBdevs(filters)
+		if ListSort != "" || ListReverse {
+			all.SortBdevs(ListSort, ListReverse)
+		}
+		listDevs(all, Format, listColumns(ListColumns, Extra))
 	},
 }
 
-func listDevs(b *bcache.BcacheDevs, format string, extra string) {
-	var extra_vals []string
-	if extra != "" {
-		extra_vals = strings.Split(extra, `,`)
+func listDevs(b *bcache.BcacheDevs, format string, columns []string) {
+	var rows [][]string
+	for i := range b.Bdevs {
+		var row []string
+		for _, j := range columns {
+			row = append(row, b.Bdevs[i].Column(j))
+		}
+		rows = append(rows, row)
 	}
-	if format == "json" {
-		out := `{`
-		jsonb_out, _ := json.Marshal(b.Bdevs)
-		jsonc_out, _ := json.Marshal(b.Cdevs)
-		out = out + `"BcacheDevs":` + string(jsonb_out) + `, "CacheDevs":` + string(jsonc_out) + `}`
-		fmt.Println(out)
-	} else if format == "short" {
+	doc := struct {
+		BcacheDevs []bcache.Bcache_bdev `json:"BcacheDevs" yaml:"BcacheDevs"`
+		CacheDevs  []bcache.Bcache_cdev `json:"CacheDevs" yaml:"CacheDevs"`
+	}{b.Bdevs, b.Cdevs}
+	if printOutput(format, output{Doc: doc, Items: b.Bdevs, Header: columns, Rows: rows}) {
+		return
+	}
+	if format == "short" {
 		for _, bdev := range b.Bdevs {
 			fmt.Println(bdev.ShortName)
 		}
 	} else {
-		printTable(b, extra_vals)
+		printTable(b, columns)
 	}
 	return
 }
 
-func printTable(b *bcache.BcacheDevs, extra_vals []string) {
+// The default columns or the given ones (comma delim), followed by the extra ones
+func listColumns(columns string, extra string) []string {
+	selected := []string{"BcacheDev", "BackingDev", "CacheDev", "cache_mode", "state"}
+	if columns != "" {
+		selected = strings.Split(columns, `,`)
+	}
+	if extra != "" {
+		selected = append(selected, strings.Split(extra, `,`)...)
+	}
+	return selected
+}
+
+func printTable(b *bcache.BcacheDevs, columns []string) {
 	if len(b.Bdevs) > 0 {
-		columns := []string{"BcacheDev", "BackingDev", "CacheDev", "cache_mode", "state"}
-		for _, val := range extra_vals {
-			columns = append(columns, val)
-		}
 		for _, j := range columns {
 			printColumn("["+j+"]")
 		}
 		fmt.Printf("\n")
-		for _, bdev := range b.Bdevs {
-			// we just add these to params map, for ease of printing
-			bdev.Parameters["BcacheDev"] = bdev.BcacheDev
-			bdev.Parameters["BackingDev"] = bdev.BackingDev
-			bdev.Parameters["CacheDev"] = bdev.CacheDev
+		for i := range b.Bdevs {
 			for _, j := range columns {
-				if bdev.Parameters[j] != nil {
-					printColumn(bdev.Parameters[j].(string))
-				}
+				printColumn(b.Bdevs[i].Column(j))
 			}
 			fmt.Printf("\n")
 		}
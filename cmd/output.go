@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// Output formats shared by list, show and print-tunables, commands render their own
+// human readable format (table, standard) for anything else
+const (
+	FORMAT_JSON     = "json"
+	FORMAT_YAML     = "yaml"
+	FORMAT_CSV      = "csv"
+	FORMAT_TEMPLATE = "template="
+)
+
+// What a command outputs, in every shared format
+type output struct {
+	// Marshalled for json and yaml
+	Doc interface{}
+	// The template is executed for every element when this is a slice, otherwise once
+	Items interface{}
+	// csv header and rows
+	Header []string
+	Rows   [][]string
+}
+
+// Write the output in format, returns false when format is not a shared format
+func (o output) write(format string) (bool, error) {
+	switch {
+	case format == FORMAT_JSON:
+		out, err := json.Marshal(o.Doc)
+		if err != nil {
+			return true, err
+		}
+		fmt.Println(string(out))
+	case format == FORMAT_YAML:
+		out, err := yaml.Marshal(o.Doc)
+		if err != nil {
+			return true, err
+		}
+		fmt.Print(string(out))
+	case format == FORMAT_CSV:
+		w := csv.NewWriter(os.Stdout)
+		w.Write(o.Header)
+		w.WriteAll(o.Rows)
+		return true, w.Error()
+	case strings.HasPrefix(format, FORMAT_TEMPLATE):
+		tmpl, err := template.New("output").Option("missingkey=zero").Parse(strings.TrimPrefix(format, FORMAT_TEMPLATE))
+		if err != nil {
+			return true, errors.New("bad output template: " + err.Error())
+		}
+		items := reflect.ValueOf(o.Items)
+		if items.Kind() != reflect.Slice {
+			items = reflect.ValueOf([]interface{}{o.Items})
+		}
+		for i := 0; i < items.Len(); i++ {
+			if err = tmpl.Execute(os.Stdout, items.Index(i).Interface()); err != nil {
+				return true, errors.New("output template: " + err.Error())
+			}
+			fmt.Println()
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Print the output in format and exit on errors, returns false when the command should
+// render format itself
+func printOutput(format string, o output) bool {
+	handled, err := o.write(format)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	return handled
+}
@@ -6,33 +6,64 @@ import (
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 	"os"
+	"sort"
 )
 
 var printTunablesCmd = &cobra.Command{
 	Use:   "print-tunables",
 	Short: "print existing listable bcache device tunables in yaml format for generating a config file",
+	Long:  "Print the current tunables of every backing device (by uuid) and cache set in the config file format. Other output formats are json, csv (section, tunable, value) and template=<go template> (executed with the config, eg. '{{range $k, $v := .Devices}}{{$k}}={{$v.cache_mode}} {{end}}').",
 	Run: func(cmd *cobra.Command, args []string) {
 		all, err := bcache.AllDevs()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
 		}
 		PrintTunables(all)
 	},
 }
 
 func PrintTunables(b *bcache.BcacheDevs) {
-	output := b.GetTunables()
+	tunables := b.GetTunables()
 	if OutConfigFile != "" {
-		out_yaml, _ := yaml.Marshal(&output)
+		out_yaml, _ := yaml.Marshal(tunables)
 		err := os.WriteFile(OutConfigFile, out_yaml, 0)
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Println("Wrote configuration to", OutConfigFile)
 	} else {
-		e := yaml.NewEncoder(os.Stdout)
-		e.Encode(&output)
+		var rows [][]string
+		for _, section := range sortedSections(tunables.Devices) {
+			for _, tunable := range sortedKeys(tunables.Devices[section]) {
+				rows = append(rows, []string{section, tunable, tunables.Devices[section][tunable]})
+			}
+		}
+		for _, section := range sortedSections(tunables.CacheSets) {
+			for _, tunable := range sortedKeys(tunables.CacheSets[section]) {
+				rows = append(rows, []string{`cache_sets/` + section, tunable, tunables.CacheSets[section][tunable]})
+			}
+		}
+		if !printOutput(PrintTunablesFormat, output{Doc: tunables, Items: tunables, Header: []string{"section", "tunable", "value"}, Rows: rows}) {
+			fmt.Println("unknown output format " + PrintTunablesFormat)
+			exit(1)
+		}
+	}
+}
+
+func sortedSections(sections map[string]bcache.DriveConfig) (names []string) {
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func sortedKeys(section bcache.DriveConfig) (keys []string) {
+	for key := range section {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return
 }
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var profilesCmd = &cobra.Command{
+	Use:   "profiles [name]",
+	Short: "List tuning profiles or show the settings of a profile",
+	Long:  "List built-in and user defined tuning profiles, or show the settings of one. User defined profiles are read from " + bcache.PROFILE_DIR + "<name>.yaml and take precedence over built-in profiles of the same name. Apply a profile with 'bcachectl tune {device} --profile name' or 'profile: name' in a config file section.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			for _, p := range bcache.ListProfiles() {
+				origin := "user"
+				if p.BuiltIn {
+					origin = "built-in"
+				}
+				fmt.Printf("%-24s%-10s%s\n", p.Name, origin, p.Description)
+			}
+			return
+		}
+		p, err := bcache.LookupProfile(args[0])
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		fmt.Printf("%-20s%s\n", "Name:", p.Name)
+		fmt.Printf("%-20s%s\n", "Description:", p.Description)
+		fmt.Println("Settings:")
+		for _, t := range bcache.TUNABLE_REGISTRY {
+			if val, found := p.Settings[t.Name]; found {
+				fmt.Printf("  %-34s%-16s(%s)\n", t.Name, val, t.Scope)
+			}
+		}
+	},
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var registerCmd = &cobra.Command{
@@ -24,7 +23,7 @@ var registerCmd = &cobra.Command{
 					all, err = bcache.AllDevs()
 					if err != nil {
 						fmt.Println(err)
-						os.Exit(1)
+						exit(1)
 					}
 					if x, y := all.IsBDevice(dev); x {
 						fmt.Println(dev, "was registered as", y.ShortName, "and is available for use.")
@@ -34,7 +33,7 @@ var registerCmd = &cobra.Command{
 				}
 			}
 			if overallErr != nil {
-				os.Exit(1)
+				exit(1)
 			}
 		}
 	},
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var replaceCacheCmd = &cobra.Command{
+	Use:   "replace-cache {old cache set uuid|cache device} {new cache device}",
+	Short: "Move all backing devices of a cache set to a new cache device",
+	Long: `Replace the cache device of a cache set, eg. a worn out SSD:
+
+  1. flush and detach every backing device of the old cache set
+  2. unregister the old cache set
+  3. format and register the new cache device
+  4. apply the cache set tunables of the old cache set to the new one
+  5. attach every backing device to the new cache set and apply its old tunables (including cache_mode)
+
+Progress is saved in ` + bcache.REPLACE_DIR + ` after every step. Running the same command again resumes an interrupted replacement. When a step fails, the backing devices that were detached are attached to the old cache set again, unless the replacement was interrupted or devices were already attached to the new cache set: progress is kept then. --rollback attaches the detached devices of an interrupted replacement to the old cache set again, devices already on the new cache set stay there.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if ReplaceRollback {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		if len(args) != 2 {
+			return errors.New("I need the old cache set (uuid or cache device) and the new cache device")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			if ReplaceRollback {
+				replaceRollback(args[0])
+				return
+			}
+			replaceCache(args[0], args[1])
+		}
+	},
+}
+
+func replaceLog(msg string) {
+	fmt.Println(msg)
+}
+
+func replaceRollback(old string) {
+	r, err := bcache.LoadReplacement(old)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	if r == nil {
+		fmt.Println("no unfinished replacement of " + old + " found in " + bcache.REPLACE_DIR)
+		exit(1)
+	}
+	if err = r.Rollback(replaceLog); err != nil {
+		fmt.Println("rollback failed:", err)
+		exit(1)
+	}
+	kept := false
+	for _, bd := range r.Backing {
+		if bd.Attached {
+			fmt.Println(bd.Device + " stays attached to the new cache set " + r.NewUUID)
+			kept = true
+		}
+	}
+	fmt.Println("Rolled back replacement of cache set " + r.OldUUID)
+	if kept {
+		fmt.Println("Progress is kept in " + bcache.REPLACE_DIR + ", run replace-cache " + r.OldUUID + " " + r.NewDev + " again to move the other devices to the new cache set")
+	}
+}
+
+func replaceCache(old string, newDev string) {
+	all, err := bcache.AllDevs()
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	r, resumed, err := all.PlanReplaceCache(old, newDev, Wipe)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	if resumed {
+		fmt.Println("Resuming replacement of cache set " + r.OldUUID + " started " + r.Started.Format("2006-01-02 15:04:05"))
+	}
+	if r.NewUUID == "" {
+		refuseInUse(Force, all.InUse(newDev))
+	}
+	if PlanOnly || DryRun {
+		for i, step := range r.Plan() {
+			fmt.Printf("%d. %s\n", i+1, step)
+		}
+		return
+	}
+	opts := bcache.NewFlushOptions()
+	opts.Strategy = FlushStrategy
+	opts.Timeout = FlushTimeout
+	progressed := false
+	opts.Progress = func(p bcache.FlushProgress) {
+		fmt.Printf("\r%-78s", formatProgress(p))
+		progressed = true
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	err = r.Run(ctx, opts, func(msg string) {
+		if progressed {
+			fmt.Println()
+			progressed = false
+		}
+		replaceLog(msg)
+	})
+	if progressed {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	fmt.Println("Replaced " + r.OldDev + " with " + r.NewDev + " (cache set " + r.NewUUID + ")")
+}
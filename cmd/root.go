@@ -3,9 +3,12 @@ package cmd
 import (
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/rafalop/bcachectl/pkg/ceph"
 	"github.com/spf13/cobra"
 	"os"
 	"os/user"
+	"strings"
+	"time"
 )
 
 func CheckAdmin(user *user.User) bool {
@@ -35,45 +38,222 @@ var NewCDev string
 var WriteBack bool
 var ApplyToAll bool
 var OutConfigFile string
+var DryRun bool
+var AuditFile string
+var AuditJournald bool
+var PlanOnly bool
+var CarveDev string
+var CarveFor string
+var CarveSizing string
+var CarveSize string
+var CarveWipe bool
+var CarveWipeTable bool
+var CarveFormat bool
+var CarveAttach bool
+var CephPrepare = ceph.NewOSDConfig()
+var CephDoit bool
+var AssumeYes bool
+var TuneExplain bool
+var TuneProfile string
+var ConfigFile string
+var BcachectlPath string
+var ManPagePath string
+var SetupCheck bool
+var TeardownPurge bool
+var FlushRecover bool
+var FlushStrategy string
+var FlushTimeout time.Duration
+var FlushDrainRate string
+var DetachFlush bool
+var DetachForce bool
+var DetachInUse bool
+var ReplaceRollback bool
+var BulkDevices []string
+var BulkLabel string
+var BulkAll bool
+var StopRecursive bool
+var Force bool
+var ListFilter string
+var ListSort string
+var ListReverse bool
+var ListColumns string
+var GraphFormat string
+var ShowFormat string
+var TreeFormat string
+var TuneFormat string
+var HistoryFormat string
+var PrintTunablesFormat string
 
 var rootCmd = &cobra.Command{
 	Use:   "bcachectl",
 	Short: "Simplified administration of bcache devices",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		bcache.Exec.DryRun = DryRun
+		if IsAdmin && (AuditFile != "" || AuditJournald) {
+			bcache.Exec.Audit = bcache.NewAuditLog(AuditFile, AuditJournald)
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if DryRun {
+			printDryRun()
+		}
+	},
+}
+
+// Print the changes recorded by the executor instead of being made
+func printDryRun() {
+	actions := bcache.Exec.Actions()
+	fmt.Println("\nDry run, no changes were made.")
+	if len(actions) > 0 {
+		fmt.Println("Changes that would have been made:")
+		for _, a := range actions {
+			fmt.Println("  " + a.String())
+		}
+	}
+}
+
+// Exit with code, printing the dry run changes first as os.Exit skips PersistentPostRun
+func exit(code int) {
+	if DryRun {
+		printDryRun()
+	}
+	os.Exit(code)
 }
 
 func Init() {
 	U, _ = user.Current()
 	IsAdmin = CheckAdmin(U)
+	rootCmd.PersistentFlags().StringVarP(&AuditFile, "audit-log", "", bcache.DEFAULT_AUDIT_LOG, "File every change is recorded in (empty to disable)")
+	rootCmd.PersistentFlags().BoolVarP(&AuditJournald, "journald", "", false, "Also record every change in the systemd journal")
+	rootCmd.PersistentFlags().BoolVarP(&DryRun, "dry-run", "n", false, "Print every sysfs write and command instead of executing it")
 	rootCmd.AddCommand(formatCmd)
 	formatCmd.Flags().BoolVarP(&Wipe, "wipe-super", "", false, "force deletion of existing filesystem superblock")
 	formatCmd.Flags().StringVarP(&NewBDev, "backing-device", "B", "", "Backing dev to create, if specified with -C, will auto attach the cache device")
 	formatCmd.Flags().StringVarP(&NewCDev, "cache-device", "C", "", "Cache dev to create, if specified with -B, will auto attach the cache device")
 	formatCmd.Flags().BoolVarP(&WriteBack, "writeback", "", false, "Use writeback caching (when auto attach specifying -B and -C)")
+	formatCmd.Flags().BoolVarP(&Force, "force", "", false, "Format even if the device is mounted, swap or held by another device")
 	rootCmd.AddCommand(listCmd)
-	listCmd.Flags().StringVarP(&Format, "format", "f", "table", "Output format [table|json|short]")
+	listCmd.Flags().StringVarP(&Format, "format", "f", "table", "Output format [table|json|yaml|csv|short|template=<go template>]")
 	listCmd.Flags().StringVarP(&Extra, "extra-vals", "e", "", "Extra settings to print (comma delim)")
+	listCmd.Flags().StringVarP(&ListColumns, "columns", "c", "", "Columns to print instead of the default ones (comma delim)")
+	listCmd.Flags().StringVarP(&ListFilter, "filter", "", "", "Only list devices matching all conditions (comma delim), eg. 'state=dirty,dirty_data>1G'")
+	listCmd.Flags().StringVarP(&ListSort, "sort", "", "", "Sort devices by a column, eg. cache_hit_ratio")
+	listCmd.Flags().BoolVarP(&ListReverse, "reverse", "", false, "Reverse the sort order")
 	rootCmd.AddCommand(registerCmd)
 	rootCmd.AddCommand(unregisterCmd)
+	unregisterCmd.Flags().BoolVarP(&Force, "force", "", false, "Unregister even if a device is mounted, swap or held by another device")
 	rootCmd.AddCommand(showCmd)
-	showCmd.Flags().StringVarP(&Format, "format", "f", "standard", "Output format [standard|json]")
+	rootCmd.AddCommand(treeCmd)
+	treeCmd.Flags().StringVarP(&TreeFormat, "format", "f", "standard", "Output format [standard|json]")
+	rootCmd.AddCommand(graphCmd)
+	graphCmd.Flags().StringVarP(&GraphFormat, "format", "f", bcache.GRAPH_DOT, "Output format ["+bcache.GRAPH_DOT+"|"+bcache.GRAPH_MERMAID+"]")
+	showCmd.Flags().StringVarP(&ShowFormat, "format", "f", "standard", "Output format [standard|json|yaml|csv|template=<go template>]")
 	rootCmd.AddCommand(tuneCmd)
+	tuneCmd.Flags().BoolVarP(&TuneExplain, "explain", "", false, "with from-file, show the effective settings of each device and the config section they came from instead of applying them")
+	tuneCmd.Flags().StringVarP(&TuneFormat, "format", "f", "table", "Output format of diff [table|json]")
+	tuneCmd.Flags().StringVarP(&TuneProfile, "profile", "p", "", "Apply a named profile (see 'bcachectl profiles')")
+	rootCmd.AddCommand(profilesCmd)
+	rootCmd.AddCommand(udevApplyCmd)
+	udevApplyCmd.Flags().StringVarP(&ConfigFile, "config", "c", bcache.DEFAULT_CONFIG, "Config file to read tunables from")
+	rootCmd.AddCommand(generateCmd)
+	generateCmd.AddCommand(generateUdevRulesCmd)
+	generateUdevRulesCmd.Flags().StringVarP(&ConfigFile, "config", "c", bcache.DEFAULT_CONFIG, "Config file the udev rule applies")
+	generateUdevRulesCmd.Flags().StringVarP(&OutConfigFile, "outfile", "o", bcache.UDEV_RULES_FILE, "Where to install the rule, '-' prints it instead")
+	generateUdevRulesCmd.Flags().StringVarP(&BcachectlPath, "bcachectl", "", "", "Path of bcachectl in the rule (default this executable)")
+	rootCmd.AddCommand(setupCmd)
+	setupCmd.Flags().BoolVarP(&SetupCheck, "check", "", false, "only report what is missing")
+	setupCmd.Flags().StringVarP(&ConfigFile, "config", "c", bcache.DEFAULT_CONFIG, "Config file to seed and apply at boot")
+	setupCmd.Flags().StringVarP(&BcachectlPath, "bcachectl", "", "", "Path of bcachectl in the systemd unit and udev rule (default this executable)")
+	setupCmd.Flags().StringVarP(&ManPagePath, "man-page", "", "", "Gzipped man page to install (default $SNAP/bcachectl.man.8.gz in the snap)")
+	rootCmd.AddCommand(teardownCmd)
+	teardownCmd.Flags().BoolVarP(&TeardownPurge, "purge", "", false, "also remove the config file")
+	teardownCmd.Flags().StringVarP(&ConfigFile, "config", "c", bcache.DEFAULT_CONFIG, "Config file used by setup")
+	teardownCmd.Flags().StringVarP(&BcachectlPath, "bcachectl", "", "", "Path of bcachectl used by setup (default this executable)")
+	teardownCmd.Flags().StringVarP(&ManPagePath, "man-page", "", "", "Man page used by setup (default $SNAP/bcachectl.man.8.gz in the snap)")
+	rootCmd.AddCommand(explainCmd)
 	rootCmd.AddCommand(printTunablesCmd)
 	printTunablesCmd.Flags().StringVarP(&OutConfigFile, "outfile", "o", "", "Write out tunables file to this file")
+	printTunablesCmd.Flags().StringVarP(&PrintTunablesFormat, "format", "f", "yaml", "Output format [yaml|json|csv|template=<go template>]")
 	rootCmd.AddCommand(flushCmd)
 	flushCmd.Flags().BoolVarP(&ApplyToAll, "all", "a", false, "flush all devices")
+	flushCmd.Flags().StringVarP(&FlushStrategy, "strategy", "s", bcache.FLUSH_WRITETHROUGH, "Flush strategy ["+strings.Join(bcache.FLUSH_STRATEGIES, "|")+"]")
+	flushCmd.Flags().DurationVarP(&FlushTimeout, "timeout", "t", 0, "Give up after this long, eg. 30s or 2h (0 waits until clean)")
+	flushCmd.Flags().StringVarP(&FlushDrainRate, "drain-rate", "", bcache.FLUSH_DRAIN_RATE, "writeback_rate_minimum in sectors/second for the drain strategy")
+	flushCmd.Flags().BoolVarP(&FlushRecover, "recover", "", false, "Restore the settings changed by interrupted flushes")
 	//tuneCmd.Flags().BoolVarP(&ApplyToAll, "all", "a", false, "apply tune to all devices")
 	rootCmd.AddCommand(attachCmd)
+	attachCmd.Flags().StringSliceVarP(&BulkDevices, "to", "", nil, "Backing devices to attach to (comma delim), eg. bcache0,bcache1")
+	attachCmd.Flags().StringVarP(&BulkLabel, "label", "", "", "Attach to backing devices whose label matches, eg. 'osd-*'")
+	attachCmd.Flags().BoolVarP(&BulkAll, "all-unattached", "", false, "Attach to every backing device without a cache")
 	rootCmd.AddCommand(superCmd)
 	rootCmd.AddCommand(detachCmd)
+	detachCmd.Flags().BoolVarP(&DetachFlush, "flush", "", false, "Flush dirty data before detaching")
+	detachCmd.Flags().BoolVarP(&DetachForce, "force", "", false, "Detach even if the device has dirty data")
+	detachCmd.Flags().BoolVarP(&DetachInUse, "force-in-use", "", false, "Detach even if the device is mounted, swap or held by another device")
+	detachCmd.Flags().StringVarP(&FlushStrategy, "strategy", "s", bcache.FLUSH_WRITETHROUGH, "Flush strategy with --flush ["+strings.Join(bcache.FLUSH_STRATEGIES, "|")+"]")
+	detachCmd.Flags().DurationVarP(&FlushTimeout, "timeout", "t", 0, "Give up waiting after this long, eg. 10m (0 waits until detached)")
+	detachCmd.Flags().StringSliceVarP(&BulkDevices, "from", "", nil, "Backing devices to detach from (comma delim), eg. bcache0,bcache1")
+	detachCmd.Flags().StringVarP(&BulkLabel, "label", "", "", "Detach from backing devices whose label matches, eg. 'osd-*'")
+	detachCmd.Flags().BoolVarP(&BulkAll, "all", "", false, "Detach from every backing device attached to the cache device")
+	rootCmd.AddCommand(stopCmd)
+	stopCmd.Flags().BoolVarP(&Force, "force", "", false, "Stop even if a device is mounted, swap or held by another device")
+	stopCmd.Flags().BoolVarP(&StopRecursive, "recursive", "r", false, "Also stop the backing devices of a cache set, or the cache set of a backing device")
+	stopCmd.Flags().StringVarP(&FlushStrategy, "strategy", "s", bcache.FLUSH_WRITETHROUGH, "Flush strategy for dirty devices ["+strings.Join(bcache.FLUSH_STRATEGIES, "|")+"]")
+	stopCmd.Flags().DurationVarP(&FlushTimeout, "timeout", "t", 0, "Give up flushing a device after this long (0 waits until clean)")
+	rootCmd.AddCommand(replaceCacheCmd)
+	replaceCacheCmd.Flags().BoolVarP(&Wipe, "wipe-super", "", false, "force deletion of existing superblocks on the new cache device")
+	replaceCacheCmd.Flags().StringVarP(&FlushStrategy, "strategy", "s", bcache.FLUSH_WRITETHROUGH, "Flush strategy before detaching ["+strings.Join(bcache.FLUSH_STRATEGIES, "|")+"]")
+	replaceCacheCmd.Flags().DurationVarP(&FlushTimeout, "timeout", "t", 0, "Give up flushing or detaching a device after this long (0 waits)")
+	replaceCacheCmd.Flags().BoolVarP(&PlanOnly, "plan", "", false, "only print the steps that would be executed")
+	replaceCacheCmd.Flags().BoolVarP(&Force, "force", "", false, "Format the new cache device even if it is mounted, swap or held by another device")
+	replaceCacheCmd.Flags().BoolVarP(&ReplaceRollback, "rollback", "", false, "Attach the detached devices of an interrupted replacement to the old cache set again")
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().StringVarP(&HistoryFormat, "format", "f", "standard", "Output format [standard|json]")
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotSaveCmd)
+	snapshotCmd.AddCommand(snapshotDiffCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotRestoreCmd.Flags().BoolVarP(&AssumeYes, "yes", "y", false, "Restore without asking for confirmation")
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().BoolVarP(&PlanOnly, "plan", "", false, "only print the steps that would be executed")
+	rootCmd.AddCommand(carveCmd)
+	carveCmd.Flags().StringVarP(&CarveDev, "cache-device", "C", "", "Cache device to partition, eg. /dev/nvme0n1")
+	carveCmd.Flags().StringVarP(&CarveFor, "for", "", "", "Backing devices to create cache partitions for (comma delim), eg. sdb,sdc")
+	carveCmd.Flags().StringVarP(&CarveSizing, "sizing", "", bcache.SIZING_EQUAL, "Partition sizing [equal|proportional|fixed]")
+	carveCmd.Flags().StringVarP(&CarveSize, "size", "", "", "Size of each partition for fixed sizing, eg. 100G")
+	carveCmd.Flags().BoolVarP(&CarveWipeTable, "wipe-table", "", false, "Replace any existing partition table on the cache device (destroys existing partitions!)")
+	carveCmd.Flags().BoolVarP(&CarveWipe, "wipe-super", "", false, "force deletion of existing superblocks on reused partitions when formatting them")
+	carveCmd.Flags().BoolVarP(&Force, "force", "", false, "Replace the partition table or format reused partitions even if they are mounted, swap or held by another device")
+	carveCmd.Flags().BoolVarP(&CarveFormat, "format", "", false, "Format and register each partition as a cache device")
+	carveCmd.Flags().BoolVarP(&CarveAttach, "attach", "", false, "Format, register and attach each partition to its backing device")
+	carveCmd.Flags().BoolVarP(&PlanOnly, "plan", "", false, "only print the partitions that would be created")
+	rootCmd.AddCommand(cephCmd)
+	cephCmd.AddCommand(cephPrepareCmd)
+	cephPrepareCmd.Flags().StringSliceVarP(&CephPrepare.DataDevices, "data-devices", "", nil, "Data device(s) to deploy (comma delim)")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.CacheDevice, "cache-device", "", "", "Disk to add a cache partition per data device to")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.CacheSize, "cache-size", "", "", "Cache partition size per data device")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.DBDevice, "db-device", "", "", "Disk to add a rocksdb partition per data device to")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.DBSize, "db-size", "", "", "DB partition size per data device")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.WALDevice, "wal-device", "", "", "Disk to add a wal partition per data device to")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.WALSize, "wal-size", "", "", "WAL partition size per data device")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.CacheMode, "cache-mode", "", CephPrepare.CacheMode, "Cache mode to set before deploying")
+	cephPrepareCmd.Flags().StringVarP(&CephPrepare.SeqCutoff, "seq-cutoff", "", CephPrepare.SeqCutoff, "Sequential cutoff to set before deploying")
+	cephPrepareCmd.Flags().BoolVarP(&CephPrepare.Reuse, "reuse", "", false, "Reuse partitions found with the right label (eg. sdX_cache, sdX_db)")
+	cephPrepareCmd.Flags().StringSliceVarP(&CephPrepare.CVArgs, "cv-args", "", nil, "Additional ceph-volume args (comma delim), eg. '--osd-id=88,--crush-device-class=foo'")
+	cephPrepareCmd.Flags().BoolVarP(&CephDoit, "doit", "", false, "Actually execute, otherwise only print the steps")
 }
 
 func Execute() {
 	Init()
 	if len(os.Args) > 1 && !IsAdmin && !(os.Args[1] == "help" || os.Args[len(os.Args)-1] == "-h" || os.Args[len(os.Args)-1] == "--help") {
-		fmt.Println("bcachectl commands require root privileges\n")
+		fmt.Printf("bcachectl commands require root privileges\n\n")
 		return
 	}
-	CheckSysFS()
+	// setup loads the module itself
+	if c, _, err := rootCmd.Find(os.Args[1:]); err != nil || (c != setupCmd && c != teardownCmd) {
+		CheckSysFS()
+	}
 	rootCmd.Execute()
 }
 
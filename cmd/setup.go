@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var setupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Prepare the host for bcache: module, systemd unit, udev rule and config file",
+	Long:  "Load the bcache module and load it at boot (" + bcache.MODULES_LOAD_FILE + "), seed the config file from the current tunables if it does not exist, install and enable " + bcache.SYSTEMD_UNIT_FILE + ", install the udev rule (" + bcache.UDEV_RULES_FILE + ") and, given --man-page or when run from the snap, the man page (" + bcache.MAN_PAGE_FILE + "). Items already in place are left alone. Use --check to only report what is missing.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		items := bcache.HostSetup(bcachectlPath(), ConfigFile, manPagePath(), false)
+		if SetupCheck {
+			exit(checkSetup(items))
+		}
+		if IsAdmin {
+			for _, item := range items {
+				if ok, _ := item.Check(); ok {
+					fmt.Printf("%-40s%s\n", item.Name, "already in place")
+					continue
+				}
+				if err := item.Install(); err != nil {
+					fmt.Printf("%-40s%s\n", item.Name, "failed: "+err.Error())
+					exit(1)
+				}
+				fmt.Printf("%-40s%s\n", item.Name, "installed")
+			}
+		}
+	},
+}
+
+var teardownCmd = &cobra.Command{
+	Use:   "teardown",
+	Short: "Remove what setup installed",
+	Long:  "Remove the man page, udev rule, systemd unit and " + bcache.MODULES_LOAD_FILE + ". The config file is kept unless --purge is used, the bcache module is not unloaded.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			items := bcache.HostSetup(bcachectlPath(), ConfigFile, manPagePath(), TeardownPurge)
+			for i := len(items) - 1; i >= 0; i-- {
+				if items[i].Remove == nil {
+					continue
+				}
+				if err := items[i].Remove(); err != nil {
+					fmt.Printf("%-40s%s\n", items[i].Name, "failed: "+err.Error())
+					exit(1)
+				}
+				fmt.Printf("%-40s%s\n", items[i].Name, "removed")
+			}
+		}
+	},
+}
+
+// Path of bcachectl used in the systemd unit and udev rule
+func bcachectlPath() string {
+	if BcachectlPath != "" {
+		return BcachectlPath
+	}
+	path, _ := os.Executable()
+	return path
+}
+
+// Gzipped man page installed by setup, the snap ships one in $SNAP
+func manPagePath() string {
+	if ManPagePath != "" {
+		return ManPagePath
+	}
+	if snap := os.Getenv("SNAP"); snap != "" {
+		return snap + "/bcachectl.man.8.gz"
+	}
+	return ""
+}
+
+// Print the state of each setup item, returns 1 when anything is missing
+func checkSetup(items []bcache.SetupItem) int {
+	ret := 0
+	for _, item := range items {
+		if ok, detail := item.Check(); ok {
+			fmt.Printf("%-40s%s\n", item.Name, "ok")
+		} else {
+			fmt.Printf("%-40s%s\n", item.Name, "missing: "+detail)
+			ret = 1
+		}
+	}
+	return ret
+}
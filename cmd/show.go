@@ -1,56 +1,83 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
+	"sort"
+	"strings"
 )
 
 var showCmd = &cobra.Command{
-	Use:   "show {bcacheN}",
-	Short: "Show detailed information about a bcache device",
-	Long:  "If a cache or backing device is supplied, info will be displayed for the bcache device which it is a member of",
+	Use:   "show {bcacheN|backing device|cache device|cache set uuid}",
+	Short: "Show detailed information about a bcache device or cache set",
+	Long:  "If a backing device is supplied, info will be displayed for the bcache device which it is a member of. A cache device or cache set uuid shows the cache set: its cache devices with size, bucket and block size, priority_stats and io errors, the attached backing devices with their state and dirty data, error counters, stats and cache set tunables.",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		all, err := bcache.AllDevs()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
 		}
-		show(all, Format, args[0])
+		show(all, ShowFormat, args[0])
 	},
 }
 
 func show(b *bcache.BcacheDevs, format string, device string) (err error) {
 	if device == "" {
 		fmt.Println("I need a device to show! specify one eg.\n bcachectl show bcache0\n bcachectl show /dev/sda")
-		os.Exit(1)
+		exit(1)
 		return
 	}
 	found := false
 	if x, y := b.IsBDevice(device); x {
+		y.Holders = bcache.DeviceUsers(y.ShortName)
 		printFullInfo(&y, format)
 		found = true
+	} else if x, _ := b.IsCDevice(device); x {
+		info, err := b.CacheSetInfo(device)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		printCacheSetInfo(&info, format)
+		found = true
 	}
 	if found == false {
-		fmt.Println("Device '" + device + "' is not a registered bcache device")
-		os.Exit(1)
+		fmt.Println("Device '" + device + "' is not a registered bcache device or cache set")
+		exit(1)
 	}
 	return
 }
 
 func printFullInfo(b *bcache.Bcache_bdev, format string) {
-	if format == "json" {
-		json_out, _ := json.Marshal(b)
-		fmt.Println(string(json_out))
-	} else {
+	columns := []string{"ShortName", "BcacheDevUUID", "CacheSetUUID", "BackingDev", "CacheDev", "Label"}
+	var params []string
+	for k := range b.Parameters {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	columns = append(columns, params...)
+	var row []string
+	for _, j := range columns {
+		row = append(row, b.Column(j))
+	}
+	if !printOutput(format, output{Doc: b, Items: b, Header: columns, Rows: [][]string{row}}) {
 		fmt.Printf("%-30s%s\n", "ShortName:", b.ShortName)
 		fmt.Printf("%-30s%s\n", "Bcache Dev UUID:", b.BUUID)
 		fmt.Printf("%-30s%s\n", "Cache Set UUID:", b.CUUID)
 		fmt.Printf("%-30s%s\n", "Backing device:", b.BackingDev)
 		fmt.Printf("%-30s%s\n", "Cache device:", b.CacheDev)
+		if len(b.Holders) == 0 {
+			fmt.Printf("%-30s%s\n", "Holders:", "none")
+		}
+		for i, u := range b.Holders {
+			label := ""
+			if i == 0 {
+				label = "Holders:"
+			}
+			fmt.Printf("%-30s%s\n", label, u.String())
+		}
 		for k, v := range b.Parameters {
 			if v != "" {
 				fmt.Printf("%-30s%s\n", k+`:`, v)
@@ -61,3 +88,74 @@ func printFullInfo(b *bcache.Bcache_bdev, format string) {
 	}
 	return
 }
+
+func printSection(title string, values bcache.DriveConfig) {
+	fmt.Println(title + ":")
+	for _, k := range sortedKeys(values) {
+		fmt.Printf("  %-28s%s\n", k+`:`, orNA(values[k]))
+	}
+}
+
+func orNA(v string) string {
+	if v == "" {
+		return "N\\A"
+	}
+	return v
+}
+
+func printCacheSetInfo(c *bcache.CacheSetInfo, format string) {
+	columns := []string{"CacheSetUUID", "Members", "BlockSize", "BucketSize", "CacheAvailablePercent", "BackingDevices"}
+	var members, backing []string
+	for _, m := range c.Members {
+		members = append(members, m.Dev)
+	}
+	for _, bdev := range c.Backing {
+		backing = append(backing, bdev.ShortName)
+	}
+	row := []string{c.UUID, strings.Join(members, " "), c.BlockSize, c.BucketSize, c.AvailablePercent, strings.Join(backing, " ")}
+	for _, k := range sortedKeys(c.Stats) {
+		columns = append(columns, k)
+		row = append(row, c.Stats[k])
+	}
+	for _, k := range sortedKeys(c.Tunables) {
+		columns = append(columns, k)
+		row = append(row, c.Tunables[k])
+	}
+	if printOutput(format, output{Doc: c, Items: c, Header: columns, Rows: [][]string{row}}) {
+		return
+	}
+	fmt.Printf("%-30s%s\n", "Cache Set UUID:", c.UUID)
+	fmt.Printf("%-30s%s\n", "Block size:", orNA(c.BlockSize))
+	fmt.Printf("%-30s%s\n", "Bucket size:", orNA(c.BucketSize))
+	fmt.Printf("%-30s%s\n", "Cache available percent:", orNA(c.AvailablePercent))
+	for _, m := range c.Members {
+		fmt.Println()
+		fmt.Printf("%-30s%s\n", "Cache device ("+m.Name+"):", m.Dev)
+		fmt.Printf("  %-28s%s\n", "Size:", orNA(m.Size))
+		fmt.Printf("  %-28s%s\n", "Buckets:", orNA(m.Buckets))
+		fmt.Printf("  %-28s%s\n", "Bucket size:", orNA(m.BucketSize))
+		fmt.Printf("  %-28s%s\n", "Block size:", orNA(m.BlockSize))
+		fmt.Printf("  %-28s%s\n", "Written:", orNA(m.Written))
+		fmt.Printf("  %-28s%s\n", "IO errors:", orNA(m.IOErrors))
+		for _, k := range sortedKeys(m.PriorityStats) {
+			fmt.Printf("  %-28s%s\n", k+`:`, m.PriorityStats[k])
+		}
+		for _, k := range sortedKeys(m.Tunables) {
+			fmt.Printf("  %-28s%s\n", k+`:`, orNA(m.Tunables[k]))
+		}
+	}
+	fmt.Println()
+	fmt.Println("Backing devices:")
+	if len(c.Backing) == 0 {
+		fmt.Println("  none")
+	} else {
+		fmt.Printf("  %-12s%-18s%-14s%-10s%-10s%s\n", "[bcache]", "[backing]", "[cache_mode]", "[state]", "[dirty]", "[label]")
+		for _, bdev := range c.Backing {
+			fmt.Printf("  %-12s%-18s%-14s%-10s%-10s%s\n", bdev.ShortName, bdev.BackingDev, bdev.CacheMode, bdev.State, bdev.DirtyData, bdev.Label)
+		}
+	}
+	fmt.Println()
+	printSection("Errors", c.Errors)
+	printSection("Stats", c.Stats)
+	printSection("Tunables", c.Tunables)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Save and restore the tunables of all bcache devices and cache sets",
+	Long:  "Snapshots capture every writable attribute of backing devices, cache sets and cache devices and are stored in " + bcache.SNAPSHOT_DIR,
+}
+
+var snapshotSaveCmd = &cobra.Command{
+	Use:   "save {name}",
+	Short: "Save the current tunables as a named snapshot",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := bcache.AllDevs()
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		s := all.TakeSnapshot(args[0])
+		if err = s.Save(); err != nil {
+			fmt.Println("Could not save snapshot: " + err.Error())
+			exit(1)
+		}
+		fmt.Printf("Saved snapshot %s (%d backing devices, %d cache sets)\n", s.Name, len(s.Backing), len(s.CacheSets))
+	},
+}
+
+var snapshotDiffCmd = &cobra.Command{
+	Use:   "diff {name}",
+	Short: "Show the differences between the current tunables and a snapshot",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, changes := snapshotDiff(args[0])
+		if len(changes) == 0 {
+			fmt.Println("Current tunables match snapshot " + args[0])
+		}
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore {name}",
+	Short: "Restore tunables from a snapshot",
+	Long:  "Show the differences to the snapshot and restore them, cache sets first, then cache devices, then backing devices (cache_mode last).",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			_, changes := snapshotDiff(args[0])
+			if len(changes) == 0 {
+				fmt.Println("Current tunables match snapshot " + args[0] + ", nothing to restore.")
+				return
+			}
+			if !AssumeYes && !DryRun && !confirm(fmt.Sprintf("Restore %d setting(s)?", len(changes))) {
+				fmt.Println("Nothing was restored.")
+				return
+			}
+			if err := bcache.RestoreSnapshot(changes); err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			fmt.Println("Restored snapshot " + args[0])
+		}
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List saved snapshots",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		names, err := bcache.ListSnapshots()
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		for _, name := range names {
+			if s, err := bcache.LoadSnapshot(name); err == nil {
+				fmt.Printf("%-30s%s\n", name, s.Time.Format("2006-01-02 15:04:05 MST"))
+			} else {
+				fmt.Printf("%-30s%s\n", name, "(unreadable: "+err.Error()+")")
+			}
+		}
+	},
+}
+
+// Load a snapshot and print how the current state differs from it
+func snapshotDiff(name string) (*bcache.Snapshot, []bcache.SnapshotChange) {
+	s, err := bcache.LoadSnapshot(name)
+	if err != nil {
+		fmt.Println("Could not load snapshot: " + err.Error())
+		exit(1)
+	}
+	all, err := bcache.AllDevs()
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	changes, missing := all.DiffSnapshot(s)
+	for _, m := range missing {
+		fmt.Println("Not registered, skipping: " + m)
+	}
+	if len(changes) > 0 {
+		fmt.Printf("%-14s%-42s%-34s%-20s%s\n", "[Scope]", "[Device]", "[Attribute]", "[Current]", "[Snapshot]")
+		for _, c := range changes {
+			fmt.Printf("%-14s%-42s%-34s%-20s%s\n", c.Scope, c.Target, c.Attribute, c.Current, c.Saved)
+		}
+	}
+	return s, changes
+}
+
+// Ask the user for confirmation on stdin
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var stopCmd = &cobra.Command{
+	Use:   "stop {cache set uuid|cache device|bcacheX}",
+	Short: "Stop a cache set or bcache device and what depends on it",
+	Long: `Stop a bcache device, or a cache set and (with --recursive) every backing device attached to it. With --recursive a backing device also takes its cache set along when no other backing device is attached to it.
+
+Dirty backing devices are flushed first (see 'bcachectl flush --help' for strategies), backing devices are stopped before their cache set and every device is waited for until it is gone from sysfs. Backing devices in use (mounted, swap, held by LVM, dm-crypt or md) are refused unless --force is used. Anything that could not be stopped is reported with the reason, eg. a mounted filesystem keeps a device in sysfs until it is unmounted.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			all, err := bcache.AllDevs()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			tree, err := all.PlanStop(args[0], StopRecursive)
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			for _, line := range tree.Lines() {
+				fmt.Println(line)
+			}
+			fmt.Println()
+			var inUse []error
+			for _, bdev := range tree.Bdevs {
+				inUse = append(inUse, bcache.CheckNotInUse(bdev.ShortName))
+			}
+			refuseInUse(Force, inUse...)
+			opts := bcache.NewFlushOptions()
+			opts.Strategy = FlushStrategy
+			opts.Timeout = FlushTimeout
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			defer stop()
+			pinned := all.StopAll(ctx, tree, Force, opts, func(msg string) {
+				fmt.Println(msg)
+			})
+			if len(pinned) > 0 {
+				fmt.Println("\nStill pinned:")
+				for _, p := range pinned {
+					fmt.Println("  " + p.Device + ": " + p.Reason)
+				}
+				exit(1)
+			}
+		}
+	},
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var superCmd = &cobra.Command{
@@ -16,7 +15,7 @@ var superCmd = &cobra.Command{
 		out, err := bcache.GetSuperBlock(args[0])
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Println(out)
 	},
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var treeCmd = &cobra.Command{
+	Use:   "tree",
+	Short: "Show cache sets, bcache devices and what uses them as a tree",
+	Long:  "Show every cache set with its cache devices and attached bcache devices, each bcache device with its backing device and the holders, mounts and swap on top of it. Idle cache sets and bcache devices without a cache set are separate roots. The json format is nested like 'lsblk --json'.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		all, err := bcache.AllDevs()
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		roots := all.Tree()
+		if TreeFormat == "json" {
+			out, _ := json.MarshalIndent(map[string][]*bcache.TreeNode{"blockdevices": roots}, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		for _, line := range bcache.TreeLines(roots) {
+			fmt.Println(line)
+		}
+	},
+}
@@ -1,30 +1,46 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
+	"sort"
 	"strings"
 )
 
 var tuneCmd = &cobra.Command{
-	Use:   "tune [{bcacheN|all} {tunable:value}] | [from-file /some/config/file]",
-	Short: "Change tunable for a bcache device or tune devices from a config file",
-	Long:  "Tune a bcache device.  Using 'from-file /file/name' will read tunables from a config file and tune each specified device or 'all' devices. Allowed tunables are:\n" + bcache.TUNABLE_DESCRIPTIONS,
-	Args:  cobra.MinimumNArgs(2),
+	Use:   "tune [{bcacheN|cset uuid|all} {tunable:value}] | [{bcacheN|cset uuid|all} --profile name] | [from-file /some/config/file] | [diff from-file /some/config/file]",
+	Short: "Change tunable for a bcache device or cache set or tune devices from a config file",
+	Long:  "Tune a bcache device or cache set.  Cache set and cache member tunables can be changed by cache set uuid, cache member tunables are applied to every cache device in the set. Using 'from-file /file/name' will read tunables from a config file and tune each specified device or 'all' devices, and cache sets listed under 'cache_sets'. Config sections can select devices by backing device uuid, 'all', mode:<cache mode>, cset:<uuid>, name:<glob>, label:<glob> or by-id:<name>, and are merged in that order of precedence (all, then selectors, then backing device uuid). Use --explain to show the effective settings of each device and the section they came from without applying them. A section can reference a profile with 'profile: name', its own settings override those of the profile, see 'bcachectl profiles'. A profile applied to a bcache device only sets its backing device tunables, cache set tunables of the profile are applied by cache set uuid (or 'all'). 'diff from-file /file/name' (or 'check') compares the config with the live values and exits 1 when any device has drifted from it, 2 on error. Allowed tunables are:\n" + bcache.TUNABLE_DESCRIPTIONS + "\n\nSee 'bcachectl explain {tunable}' for details of a tunable.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if TuneProfile != "" {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		return cobra.MinimumNArgs(2)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		if IsAdmin {
 			all, err := bcache.AllDevs()
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(1)
+				// exit 1 means drift for diff
+				if args[0] == "diff" || args[0] == "check" {
+					exit(2)
+				}
+				exit(1)
 			}
-			if args[0] == "from-file" {
+			if TuneProfile != "" {
+				tuneProfile(all, args[0], TuneProfile)
+			} else if (args[0] == "diff" || args[0] == "check") && len(args) == 3 && args[1] == "from-file" {
+				exit(tuneDiff(all, args[2], TuneFormat))
+			} else if args[0] == "from-file" && TuneExplain {
+				explainConfig(all, args[1])
+			} else if args[0] == "from-file" {
 				err = all.TuneFromFile(args[1])
 				if err != nil {
 					fmt.Println(err)
-					os.Exit(1)
+					exit(1)
 				} else {
 					fmt.Println("Applied tunables from", args[1])
 				}
@@ -35,9 +51,143 @@ var tuneCmd = &cobra.Command{
 	},
 }
 
+// Apply a profile to a bcache device (backing device tunables only), a cache set (cache set
+// tunables only) or all devices and cache sets
+func tuneProfile(b *bcache.BcacheDevs, device string, name string) {
+	p, err := bcache.LookupProfile(name)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	setSettings := p.ScopeSettings(bcache.SCOPE_CACHE_SET, bcache.SCOPE_CACHE)
+	if device == "all" {
+		var overallErr error
+		for _, dev := range b.Bdevs {
+			if err = dev.ApplyProfile(p); err != nil {
+				fmt.Printf("%s could not be tuned (profile %s): %s\n", dev.ShortName, name, err)
+				overallErr = err
+			} else {
+				fmt.Printf("%s was tuned successfully (profile %s)\n", dev.ShortName, name)
+			}
+		}
+		if len(setSettings) > 0 {
+			for _, cdev := range b.Cdevs {
+				if err = cdev.ApplyProfile(p); err != nil {
+					fmt.Printf("cache set %s could not be tuned (profile %s): %s\n", cdev.UUID, name, err)
+					overallErr = err
+				} else {
+					fmt.Printf("cache set %s was tuned successfully (profile %s)\n", cdev.UUID, name)
+				}
+			}
+		}
+		if overallErr != nil {
+			exit(1)
+		}
+		return
+	}
+	var bdev bcache.Bcache_bdev
+	if isSet, cdev := b.IsCDevice(device); isSet && cdev.UUID == device {
+		err = cdev.ApplyProfile(p)
+	} else if x, y := b.IsBDevice(device); x {
+		bdev = y
+		err = y.ApplyProfile(p)
+	} else {
+		fmt.Printf("%s does not appear to be a valid bcache device or cache set (expecting valid bcacheXY or cache set uuid)\n\n", device)
+		exit(1)
+	}
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	fmt.Printf("%s was tuned successfully (profile %s)\n", device, name)
+	if bdev.ShortName != "" && len(setSettings) > 0 {
+		var tunables []string
+		for tunable := range setSettings {
+			tunables = append(tunables, tunable)
+		}
+		sort.Strings(tunables)
+		fmt.Printf("Cache set tunables of the profile were not applied, they are shared by every device of the cache set: %s\n", strings.Join(tunables, ", "))
+		if bdev.CUUID != bcache.NONE_ATTACHED {
+			fmt.Printf("Apply them with 'bcachectl tune %s --profile %s'\n", bdev.CUUID, name)
+		}
+	}
+}
+
+// Print where live values differ from a config file, returns the exit code: 0 when
+// everything matches, 1 on drift and 2 on error
+func tuneDiff(b *bcache.BcacheDevs, configFile string, format string) int {
+	cfg := bcache.NewTuneConfig()
+	if err := bcache.Parse(cfg, configFile); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	drift, err := b.DiffConfig(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if format == "json" {
+		if drift == nil {
+			drift = []bcache.ConfigDrift{}
+		}
+		json_out, _ := json.Marshal(drift)
+		fmt.Println(string(json_out))
+	} else if len(drift) == 0 {
+		fmt.Println("All devices match", configFile)
+	} else {
+		fmt.Printf("%-14s%-42s%-34s%-16s%-16s%s\n", "[Scope]", "[Device]", "[Tunable]", "[Current]", "[Desired]", "[From]")
+		for _, d := range drift {
+			fmt.Printf("%-14s%-42s%-34s%-16s%-16s%s\n", d.Scope, d.Target, d.Tunable, d.Current, d.Desired, d.Section)
+		}
+	}
+	if len(drift) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Print the effective settings of each device from a config file and the sections they came from
+func explainConfig(b *bcache.BcacheDevs, configFile string) {
+	cfg := bcache.NewTuneConfig()
+	if err := bcache.Parse(cfg, configFile); err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	for _, bdev := range b.Bdevs {
+		settings, err := cfg.Resolve(&bdev)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		fmt.Printf("%s (%s, %s)\n", bdev.ShortName, bdev.BackingDev, bdev.BUUID)
+		printEffective(settings)
+	}
+	for _, cdev := range b.Cdevs {
+		fmt.Printf("cache set %s (%s)\n", cdev.UUID, cdev.Dev)
+		settings, err := cfg.ResolveCacheSet(cdev.UUID)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		printEffective(settings)
+	}
+}
+
+func printEffective(settings []bcache.EffectiveSetting) {
+	if len(settings) == 0 {
+		fmt.Printf("  (no settings)\n\n")
+		return
+	}
+	fmt.Printf("  %-34s%-16s%-30s%s\n", "[Tunable]", "[Value]", "[From]", "[Overrides]")
+	for _, s := range settings {
+		fmt.Printf("  %-34s%-16s%-30s%s\n", s.Tunable, s.Value, s.Section, strings.Join(s.Overrides, ", "))
+	}
+	fmt.Println()
+}
+
 func printTunables() {
-	for _, j := range bcache.TUNABLES {
-		fmt.Printf("%s\n", bcache.BaseName(j))
+	for _, t := range bcache.TUNABLE_REGISTRY {
+		fmt.Printf("%s\n", t.Name)
 	}
 	return
 }
@@ -56,8 +206,19 @@ func tune(b *bcache.BcacheDevs, device string, tunable string) {
 		fmt.Println("I need a registered device to tune, eg.\n bcachectl tune bcache0 tunable_name:tunable_val\n\nor use \"all\" to apply the same tunable to all registered devices.")
 	} else if !all {
 		// Tune single
-		if x, y = b.IsBDevice(device); !x {
-			fmt.Println(device, "does not appear to be a valid bcache device (expecting valid bcacheXY)\n")
+		if isSet, cdev := b.IsCDevice(device); isSet && cdev.UUID == device {
+			err = cdev.Tune(tunable)
+			if err != nil {
+				fmt.Println(err)
+				if strings.Contains(err.Error(), "allowed") {
+					fmt.Println("\nAllowed tunables: ")
+					printTunables()
+				}
+				exit(1)
+			}
+			fmt.Printf("cache set %s was tuned successfully (%s)\n", device, tunable)
+		} else if x, y = b.IsBDevice(device); !x {
+			fmt.Printf("%s does not appear to be a valid bcache device or cache set (expecting valid bcacheXY or cache set uuid)\n\n", device)
 		} else {
 			err = y.Tune(tunable)
 			if err != nil {
@@ -66,7 +227,7 @@ func tune(b *bcache.BcacheDevs, device string, tunable string) {
 					fmt.Println("\nAllowed tunables: ")
 					printTunables()
 				}
-				os.Exit(1)
+				exit(1)
 			} else {
 				fmt.Printf("%s was tuned successfully (%s)\n", device, tunable)
 			}
@@ -84,7 +245,7 @@ func tune(b *bcache.BcacheDevs, device string, tunable string) {
 		}
 	}
 	if overallErr != nil {
-		os.Exit(1)
+		exit(1)
 	}
 	return
 }
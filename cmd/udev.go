@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"github.com/spf13/cobra"
+)
+
+var udevApplyCmd = &cobra.Command{
+	Use:   "udev-apply {bcacheN}",
+	Short: "Apply the config file settings matching a single bcache device (run from udev)",
+	Long:  "Apply the settings of the config file that match a single bcache device. This is run by the udev rule installed with 'bcachectl generate udev-rules' when a bcache device is added, so devices registered after boot are tuned too.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if IsAdmin {
+			all, err := bcache.AllDevs()
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			if err = all.TuneDeviceFromFile(ConfigFile, args[0]); err != nil {
+				fmt.Printf("%s could not be tuned from %s: %s\n", args[0], ConfigFile, err)
+				exit(1)
+			}
+			fmt.Println("Applied tunables from", ConfigFile, "to", args[0])
+		}
+	},
+}
+
+var generateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate integration files for the system",
+}
+
+var generateUdevRulesCmd = &cobra.Command{
+	Use:   "udev-rules",
+	Short: "Install a udev rule that tunes bcache devices when they are added",
+	Long:  "Install a udev rule (" + bcache.UDEV_RULES_FILE + ") running 'bcachectl udev-apply' for every bcache device that is added, and reload the udev rules. Use '--outfile -' to only print the rule.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		binary := bcachectlPath()
+		if OutConfigFile == "-" {
+			fmt.Print(bcache.UdevRule(binary, ConfigFile))
+			return
+		}
+		if IsAdmin {
+			if err := bcache.InstallUdevRule(OutConfigFile, binary, ConfigFile); err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
+			fmt.Println("Installed udev rule", OutConfigFile)
+		}
+	},
+}
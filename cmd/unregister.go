@@ -4,20 +4,25 @@ import (
 	"fmt"
 	"github.com/rafalop/bcachectl/pkg/bcache"
 	"github.com/spf13/cobra"
-	"os"
 )
 
 var unregisterCmd = &cobra.Command{
 	Use:   "unregister {bcacheX} {bcacheY} ... {deviceN}",
 	Short: "unregister formatted bcache device(s)",
+	Long:  "Unregister backing devices or cache sets. Devices in use (mounted, swap, held by LVM, dm-crypt or md) are refused unless --force is used, for a cache set every attached backing device is checked.",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		if IsAdmin {
 			all, err := bcache.AllDevs()
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(1)
+				exit(1)
 			}
+			var inUse []error
+			for _, dev := range args[0:] {
+				inUse = append(inUse, all.InUse(dev))
+			}
+			refuseInUse(Force, inUse...)
 			var overallErr error
 			for _, dev := range args[0:] {
 				err := all.Unregister(dev)
@@ -33,8 +38,31 @@ var unregisterCmd = &cobra.Command{
 				}
 			}
 			if overallErr != nil {
-				os.Exit(1)
+				exit(1)
 			}
 		}
 	},
 }
+
+// Print what is using the devices and exit, unless force is set
+func refuseInUse(force bool, inUse ...error) {
+	refuseInUseFlag(force, "--force", inUse...)
+}
+
+// Same as refuseInUse, for commands where the override is not --force
+func refuseInUseFlag(force bool, flag string, inUse ...error) {
+	if force {
+		return
+	}
+	refused := false
+	for _, err := range inUse {
+		if err != nil {
+			fmt.Println(err)
+			refused = true
+		}
+	}
+	if refused {
+		fmt.Println("Refusing to continue, use " + flag + " to do it anyway.")
+		exit(1)
+	}
+}
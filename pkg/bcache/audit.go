@@ -0,0 +1,206 @@
+package bcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_AUDIT_LOG = `/var/log/bcachectl/audit.jsonl`
+const JOURNALD_SOCKET = `/run/systemd/journal/socket`
+const LOGINUID_PATH = `/proc/self/loginuid`
+
+// loginuid of a process that was not started from a login session
+const unsetLoginUID = "4294967295"
+
+// A single change made by bcachectl
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	UID  int       `json:"uid"`
+	// the user that ran bcachectl through sudo, and the user that logged in, which stays
+	// the same through sudo and su
+	SudoUID   string `json:"sudo_uid,omitempty"`
+	SudoUser  string `json:"sudo_user,omitempty"`
+	LoginUID  string `json:"loginuid,omitempty"`
+	CmdLine   string `json:"cmdline"`
+	Device    string `json:"device,omitempty"`
+	Attribute string `json:"attribute,omitempty"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Who made the change, eg. "uid=0 sudo=alice(1000) loginuid=1000"
+func (e AuditEntry) Who() string {
+	who := "uid=" + strconv.Itoa(e.UID)
+	if e.SudoUser != "" || e.SudoUID != "" {
+		who += " sudo=" + e.SudoUser + "(" + e.SudoUID + ")"
+	}
+	if e.LoginUID != "" {
+		who += " loginuid=" + e.LoginUID
+	}
+	return who
+}
+
+// The uid of the login session, empty if there is none
+func loginUID() string {
+	uid := readVal(LOGINUID_PATH)
+	if uid == unsetLoginUID {
+		return ""
+	}
+	return uid
+}
+
+// Appends entries to a jsonl file and optionally to journald
+type AuditLog struct {
+	File     string
+	Journald bool
+	mu       sync.Mutex
+}
+
+func NewAuditLog(file string, journald bool) *AuditLog {
+	return &AuditLog{File: file, Journald: journald}
+}
+
+// Work out the device and attribute changed by a write to path
+func auditTarget(path string, val string) (device string, attribute string) {
+	switch {
+	case path == SYSFS_BCACHE_ROOT+`register`:
+		return val, `register`
+	case strings.HasPrefix(path, SYSFS_BCACHE_ROOT):
+		rel := strings.SplitN(strings.TrimPrefix(path, SYSFS_BCACHE_ROOT), "/", 2)
+		if len(rel) == 2 {
+			return rel[0], rel[1]
+		}
+	case strings.HasPrefix(path, SYSFS_BLOCK_ROOT):
+		rel := strings.SplitN(strings.TrimPrefix(path, SYSFS_BLOCK_ROOT), `/bcache/`, 2)
+		if len(rel) == 2 {
+			return filepath.Base(rel[0]), rel[1]
+		}
+	case strings.HasPrefix(path, "/dev/"):
+		return path, `partition table`
+	}
+	return path, ""
+}
+
+// Devices named in a command line, eg. those given to make-bcache or wipefs
+func commandDevices(cmd string) string {
+	var devs []string
+	for _, arg := range strings.Fields(cmd) {
+		if strings.HasPrefix(arg, "/dev/") {
+			devs = append(devs, arg)
+		}
+	}
+	return strings.Join(devs, ",")
+}
+
+// Build an entry for action a, reading the value it replaces from sysfs. Must be called
+// before the change is made.
+func (l *AuditLog) Entry(a Action) (e AuditEntry) {
+	e = AuditEntry{
+		Time:     time.Now(),
+		UID:      os.Getuid(),
+		SudoUID:  os.Getenv("SUDO_UID"),
+		SudoUser: os.Getenv("SUDO_USER"),
+		LoginUID: loginUID(),
+		CmdLine:  strings.Join(os.Args, " "),
+		New:      a.Value,
+		Command:  a.Command,
+	}
+	if a.Command != "" {
+		e.Device = commandDevices(a.Command)
+		return
+	}
+	e.Device, e.Attribute = auditTarget(a.Path, a.Value)
+	if strings.HasPrefix(a.Path, "/sys/") {
+		e.Old = selectedVal(readVal(a.Path))
+	}
+	return
+}
+
+// Append an entry to the log file (and journald)
+func (l *AuditLog) Write(e AuditEntry) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Journald {
+		l.writeJournald(e)
+	}
+	if l.File == "" {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(l.File), 0750); err != nil {
+		return
+	}
+	f, err := os.OpenFile(l.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	line, _ := json.Marshal(e)
+	_, err = f.Write(append(line, '\n'))
+	return
+}
+
+// Send the entry with the journald native protocol, best effort
+func (l *AuditLog) writeJournald(e AuditEntry) {
+	conn, err := net.Dial("unixgram", JOURNALD_SOCKET)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	msg := "bcachectl changed " + e.Device
+	if e.Attribute != "" {
+		msg += " " + e.Attribute + " from '" + e.Old + "' to '" + e.New + "'"
+	} else if e.Command != "" {
+		msg += " running '" + e.Command + "'"
+	}
+	fields := [][2]string{
+		{"MESSAGE", msg},
+		{"SYSLOG_IDENTIFIER", "bcachectl"},
+		{"PRIORITY", "5"},
+		{"BCACHECTL_UID", strconv.Itoa(e.UID)},
+		{"BCACHECTL_SUDO_UID", e.SudoUID},
+		{"BCACHECTL_SUDO_USER", e.SudoUser},
+		{"BCACHECTL_LOGINUID", e.LoginUID},
+		{"BCACHECTL_CMDLINE", e.CmdLine},
+		{"BCACHECTL_DEVICE", e.Device},
+		{"BCACHECTL_ATTRIBUTE", e.Attribute},
+		{"BCACHECTL_OLD", e.Old},
+		{"BCACHECTL_NEW", e.New},
+		{"BCACHECTL_COMMAND", e.Command},
+		{"BCACHECTL_ERROR", e.Error},
+	}
+	var b strings.Builder
+	for _, f := range fields {
+		if f[1] != "" {
+			b.WriteString(f[0] + "=" + strings.ReplaceAll(f[1], "\n", " ") + "\n")
+		}
+	}
+	conn.Write([]byte(b.String()))
+}
+
+// Read all entries of an audit log file, oldest first
+func ReadAuditLog(file string) (entries []AuditEntry, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,104 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// Outcome of a bulk operation on one backing device, Changed is false when the device was
+// already in the wanted state
+type BulkResult struct {
+	Device     string
+	BackingDev string
+	Changed    bool
+	Err        error
+}
+
+// Backing devices for a bulk operation: the named devices (bcacheN, /dev/bcacheN or backing
+// device), devices whose label matches the glob label, and every device matching all when
+// it is set. Devices are returned once, in the order they were found.
+func (b *BcacheDevs) SelectBdevs(devices []string, label string, all func(*Bcache_bdev) bool) (selected []Bcache_bdev, err error) {
+	if label != "" {
+		if _, err = filepath.Match(label, ""); err != nil {
+			return nil, errors.New("bad label pattern " + label + ": " + err.Error())
+		}
+	}
+	seen := make(map[string]bool)
+	add := func(bdev Bcache_bdev) {
+		if !seen[bdev.ShortName] {
+			seen[bdev.ShortName] = true
+			selected = append(selected, bdev)
+		}
+	}
+	for _, dev := range devices {
+		x, bdev := b.IsBDevice(dev)
+		if !x {
+			return nil, errors.New(dev + " is not a registered backing device.")
+		}
+		add(bdev)
+	}
+	for i := range b.Bdevs {
+		bdev := &b.Bdevs[i]
+		if label != "" && bdev.Label != "" {
+			if matched, _ := filepath.Match(label, bdev.Label); matched {
+				add(*bdev)
+				continue
+			}
+		}
+		if all != nil && all(bdev) {
+			add(*bdev)
+		}
+	}
+	return
+}
+
+// Run f for every device concurrently, results are in the order of bdevs
+func bulkRun(bdevs []Bcache_bdev, f func(bdev Bcache_bdev) (bool, error)) []BulkResult {
+	results := make([]BulkResult, len(bdevs))
+	var wg sync.WaitGroup
+	for i, bdev := range bdevs {
+		wg.Add(1)
+		go func(i int, bdev Bcache_bdev) {
+			defer wg.Done()
+			changed, err := f(bdev)
+			results[i] = BulkResult{Device: bdev.ShortName, BackingDev: bdev.BackingDev, Changed: changed, Err: err}
+		}(i, bdev)
+	}
+	wg.Wait()
+	return results
+}
+
+// Attach cache set cdev to every device in bdevs concurrently. Devices already attached
+// to it are left unchanged, devices attached to another cache set fail.
+func (b *BcacheDevs) BulkAttach(cdev string, bdevs []Bcache_bdev) ([]BulkResult, error) {
+	x, c := b.IsCDevice(cdev)
+	if !x {
+		return nil, errors.New(cdev + " does not appear to be a formatted and registered CACHE device.")
+	}
+	return bulkRun(bdevs, func(bdev Bcache_bdev) (bool, error) {
+		switch bdev.CUUID {
+		case c.UUID:
+			return false, nil
+		case NONE_ATTACHED:
+			return true, b.Attach(c.UUID, bdev.ShortName)
+		}
+		return false, errors.New("already attached to cache set " + bdev.CUUID)
+	}), nil
+}
+
+// Detach every device in bdevs from cache set cdev concurrently with SafeDetach, devices not
+// attached to it are left unchanged
+func (b *BcacheDevs) BulkDetach(ctx context.Context, cdev string, bdevs []Bcache_bdev, flush bool, force bool, opts FlushOptions) ([]BulkResult, error) {
+	x, c := b.IsCDevice(cdev)
+	if !x {
+		return nil, errors.New(cdev + " is not a registered cache device.")
+	}
+	return bulkRun(bdevs, func(bdev Bcache_bdev) (bool, error) {
+		if bdev.CUUID != c.UUID {
+			return false, nil
+		}
+		return true, b.SafeDetach(ctx, c.UUID, bdev.ShortName, flush, force, opts)
+	}), nil
+}
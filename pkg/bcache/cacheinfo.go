@@ -0,0 +1,137 @@
+package bcache
+
+import (
+	"errors"
+	"strings"
+)
+
+// A cache device of a cache set (cache0, cache1...)
+type CacheMember struct {
+	Name       string `json:"Name" yaml:"Name"`
+	Dev        string `json:"Device" yaml:"Device"`
+	Size       string `json:"Size" yaml:"Size"`
+	BucketSize string `json:"BucketSize" yaml:"BucketSize"`
+	BlockSize  string `json:"BlockSize" yaml:"BlockSize"`
+	Buckets    string `json:"Buckets" yaml:"Buckets"`
+	IOErrors   string `json:"IOErrors" yaml:"IOErrors"`
+	Written    string `json:"Written" yaml:"Written"`
+	// Bucket usage from priority_stats, eg. Unused: 87%
+	PriorityStats DriveConfig `json:"PriorityStats" yaml:"PriorityStats"`
+	Tunables      DriveConfig `json:"Tunables" yaml:"Tunables"`
+}
+
+// A backing device attached to a cache set
+type AttachedBdev struct {
+	ShortName  string `json:"ShortName" yaml:"ShortName"`
+	BackingDev string `json:"BackingDev" yaml:"BackingDev"`
+	Label      string `json:"Label" yaml:"Label"`
+	CacheMode  string `json:"CacheMode" yaml:"CacheMode"`
+	State      string `json:"State" yaml:"State"`
+	DirtyData  string `json:"DirtyData" yaml:"DirtyData"`
+}
+
+// Everything about a cache set, for 'bcachectl show'
+type CacheSetInfo struct {
+	UUID             string         `json:"CacheSetUUID" yaml:"CacheSetUUID"`
+	BlockSize        string         `json:"BlockSize" yaml:"BlockSize"`
+	BucketSize       string         `json:"BucketSize" yaml:"BucketSize"`
+	AvailablePercent string         `json:"CacheAvailablePercent" yaml:"CacheAvailablePercent"`
+	Members          []CacheMember  `json:"Members" yaml:"Members"`
+	Backing          []AttachedBdev `json:"BackingDevices" yaml:"BackingDevices"`
+	Errors           DriveConfig    `json:"Errors" yaml:"Errors"`
+	Stats            DriveConfig    `json:"Stats" yaml:"Stats"`
+	Tunables         DriveConfig    `json:"Tunables" yaml:"Tunables"`
+}
+
+var CACHE_SET_STATS = []string{
+	`stats_total/cache_hits`,
+	`stats_total/cache_misses`,
+	`stats_total/cache_hit_ratio`,
+	`stats_total/bypassed`,
+	`average_key_size`,
+	`btree_cache_size`,
+	`root_usage_percent`,
+	`tree_depth`,
+}
+
+// Set level error counters, io errors are counted per cache device
+var CACHE_SET_ERRORS = []string{
+	`internal/cache_read_races`,
+	`internal/writeback_keys_failed`,
+}
+
+// Parse priority_stats, eg. "Unused:		87%\nMetadata:	0%" to Unused: 87%, Metadata: 0%
+func parsePriorityStats(raw string) DriveConfig {
+	stats := make(DriveConfig)
+	for _, line := range strings.Split(raw, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			stats[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return stats
+}
+
+// Gather the details of a cache set, device is a cache set uuid or cache device
+func (b *BcacheDevs) CacheSetInfo(device string) (info CacheSetInfo, err error) {
+	x, cdev := b.IsCDevice(device)
+	if !x {
+		return info, errors.New(device + " is not a registered cache set or cache device")
+	}
+	root := SYSFS_BCACHE_ROOT + cdev.UUID + `/`
+	info = CacheSetInfo{
+		UUID:             cdev.UUID,
+		BlockSize:        normalizeSize(ReadSysfs(root + `block_size`)),
+		BucketSize:       normalizeSize(ReadSysfs(root + `bucket_size`)),
+		AvailablePercent: ReadSysfs(root + `cache_available_percent`),
+		Errors:           make(DriveConfig),
+		Stats:            make(DriveConfig),
+		Tunables:         make(DriveConfig),
+	}
+	for _, member := range cacheSetMembers(cdev.UUID) {
+		dir := root + member + `/`
+		dev := cacheMemberDev(cdev.UUID, member)
+		m := CacheMember{
+			Name:          member,
+			Dev:           dev,
+			Size:          deviceCapacity(dev),
+			BucketSize:    normalizeSize(ReadSysfs(dir + `bucket_size`)),
+			BlockSize:     normalizeSize(ReadSysfs(dir + `block_size`)),
+			Buckets:       ReadSysfs(dir + `nbuckets`),
+			IOErrors:      ReadSysfs(dir + `io_errors`),
+			Written:       normalizeSize(ReadSysfs(dir + `written`)),
+			PriorityStats: parsePriorityStats(readVal(dir + `priority_stats`)),
+			Tunables:      make(DriveConfig),
+		}
+		for _, t := range TUNABLE_REGISTRY {
+			if t.Scope == SCOPE_CACHE {
+				m.Tunables[t.Name] = ReadSysfs(dir + t.Path)
+			}
+		}
+		info.Members = append(info.Members, m)
+	}
+	for _, bdev := range b.attachedTo(cdev.UUID) {
+		info.Backing = append(info.Backing, AttachedBdev{
+			ShortName:  bdev.ShortName,
+			BackingDev: bdev.BackingDev,
+			Label:      bdev.Label,
+			CacheMode:  bdev.Val(`cache_mode`),
+			State:      bdev.Val(`state`),
+			DirtyData:  normalizeSize(bdev.Val(`dirty_data`)),
+		})
+	}
+	for _, stat := range CACHE_SET_STATS {
+		name := stat[strings.LastIndex(stat, "/")+1:]
+		info.Stats[name] = normalizeSize(ReadSysfs(root + stat))
+	}
+	for _, stat := range CACHE_SET_ERRORS {
+		name := stat[strings.LastIndex(stat, "/")+1:]
+		info.Errors[name] = ReadSysfs(root + stat)
+	}
+	for _, t := range TUNABLE_REGISTRY {
+		if t.Scope == SCOPE_CACHE_SET {
+			info.Tunables[t.Name] = ReadSysfs(root + t.Path)
+		}
+	}
+	return
+}
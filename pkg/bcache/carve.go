@@ -0,0 +1,184 @@
+package bcache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How the free space of a cache device is shared between backing devices
+const (
+	SIZING_EQUAL        = "equal"
+	SIZING_FIXED        = "fixed"
+	SIZING_PROPORTIONAL = "proportional"
+)
+
+// A partition on a cache device intended as cache for a single backing device
+type CarvedPartition struct {
+	Backing  string
+	Label    string
+	Device   string
+	Size     uint64
+	Existing bool
+	part     GptPartition
+}
+
+// Partition label used for the cache of a backing device, eg. sdb_cache
+func CacheLabel(backing string) string {
+	return filepath.Base(backing) + "_cache"
+}
+
+// Size of a block device in bytes from sysfs
+func BlockDevSize(dev string) (size uint64, err error) {
+	sectors := readVal(`/sys/class/block/` + filepath.Base(resolveDev(dev)) + `/size`)
+	n, err := strconv.ParseUint(sectors, 10, 64)
+	if err != nil {
+		return 0, errors.New("could not determine size of " + dev)
+	}
+	return n * 512, nil
+}
+
+// Work out the partitions needed on cacheDev for each backing device. Partitions already
+// carrying the right label are reused. For fixed sizing every new partition gets size bytes,
+// otherwise the largest free region is shared equally or in proportion to the backing
+// device sizes. Nothing is written to the disk, see Carve.
+func PlanCarve(cacheDev string, backing []string, sizing string, size uint64, wipe bool) (t *GptTable, parts []CarvedPartition, err error) {
+	t, err = ReadGPT(resolveDev(cacheDev), wipe)
+	if err != nil {
+		return
+	}
+	var todo []int
+	for _, bk := range backing {
+		if _, err = os.Stat(bk); err != nil {
+			return nil, nil, errors.New("backing device " + bk + " does not exist")
+		}
+		cp := CarvedPartition{Backing: bk, Label: CacheLabel(bk)}
+		if found, p := t.FindByName(cp.Label); found {
+			cp.Existing = true
+			cp.Device = t.PartitionDev(p.Number)
+			cp.Size = t.PartitionSize(p)
+			cp.part = p
+		} else {
+			todo = append(todo, len(parts))
+		}
+		parts = append(parts, cp)
+	}
+	if len(todo) == 0 {
+		return
+	}
+	switch sizing {
+	case SIZING_FIXED:
+		if size == 0 {
+			return nil, nil, errors.New("fixed sizing needs a partition size")
+		}
+		for _, i := range todo {
+			parts[i].Size = size
+		}
+	case SIZING_EQUAL, SIZING_PROPORTIONAL:
+		var largest uint64
+		for _, r := range t.FreeRegions() {
+			if s := (r.LastLBA - r.FirstLBA + 1) * t.SectorSize; s > largest {
+				largest = s
+			}
+		}
+		weights := make([]float64, len(todo))
+		var total float64
+		for j, i := range todo {
+			weights[j] = 1
+			if sizing == SIZING_PROPORTIONAL {
+				s, err := BlockDevSize(parts[i].Backing)
+				if err != nil {
+					return nil, nil, err
+				}
+				weights[j] = float64(s)
+			}
+			total += weights[j]
+		}
+		for j, i := range todo {
+			parts[i].Size = uint64(float64(largest) * weights[j] / total)
+		}
+	default:
+		return nil, nil, errors.New("unknown sizing " + sizing + ", use one of " + SIZING_EQUAL + ", " + SIZING_FIXED + ", " + SIZING_PROPORTIONAL)
+	}
+	for _, i := range todo {
+		p, err := t.AddPartition(parts[i].Label, parts[i].Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts[i].part = p
+		parts[i].Device = t.PartitionDev(p.Number)
+		parts[i].Size = t.PartitionSize(p)
+	}
+	return
+}
+
+// Error when the disk or one of its partitions is a registered cache or backing device, so
+// its partition table must not be replaced
+func (b *BcacheDevs) CheckNotRegistered(disk string) error {
+	var registered []string
+	for _, name := range withPartitions(blockName(disk)) {
+		if x, _ := b.IsCDevice(`/dev/` + name); x {
+			registered = append(registered, `/dev/`+name+" is a registered cache device")
+		} else if x, _ := b.IsBDevice(`/dev/` + name); x {
+			registered = append(registered, `/dev/`+name+" is a registered backing device")
+		}
+	}
+	if len(registered) > 0 {
+		return errors.New("can't replace the partition table of " + disk + ": " + strings.Join(registered, ", "))
+	}
+	return nil
+}
+
+// Write the partition table and wait for the new partitions to appear in /dev
+func Carve(t *GptTable, parts []CarvedPartition) error {
+	var created []GptPartition
+	for _, p := range parts {
+		if !p.Existing {
+			created = append(created, p.part)
+		}
+	}
+	return t.Commit(created)
+}
+
+// Format and register a carved partition as a cache device, optionally attaching it to
+// its backing device (which must already be a registered bcache device). Newly created
+// partitions are always wiped first, since they may contain stale data from older partitions.
+func (c *CarvedPartition) MakeCache(attach bool, wipe bool) error {
+	all, err := AllDevs()
+	if err != nil {
+		return err
+	}
+	if x, _ := all.IsCDevice(c.Device); !x {
+		if c.Existing && IsFormatted(c.Device) {
+			err = Register(c.Device)
+		} else {
+			err = all.Format("", c.Device, wipe || !c.Existing, false)
+		}
+		if err != nil {
+			return err
+		}
+		if all, err = AllDevs(); err != nil {
+			return err
+		}
+	}
+	if !attach {
+		return nil
+	}
+	x, b := all.IsBDevice(resolveDev(c.Backing))
+	if !x {
+		return errors.New(c.Backing + " is not a registered backing device, format it first (bcachectl format -B " + c.Backing + ")")
+	}
+	cdev, err := all.LookupCDevice(c.Device)
+	if err != nil {
+		return err
+	}
+	if b.CUUID == cdev.UUID {
+		return nil
+	}
+	if b.CUUID != NONE_ATTACHED && b.CUUID != "" {
+		return errors.New(c.Backing + " (" + b.ShortName + ") already has cache set " + b.CUUID + " attached")
+	}
+	return all.Attach(c.Device, b.BackingDev)
+}
@@ -33,36 +33,28 @@ var STATS = []string{
 	`dirty_data`,
 }
 
-var TUNABLES = []string{
-	`cache_mode`,
-	`cache/cache0/cache_replacement_policy`,
-	`cache/congested_write_threshold_us`,
-	`cache/congested_read_threshold_us`,
-	`readahead_cache_policy`,
-	`sequential_cutoff`,
-	`writeback_delay`,
-	`writeback_percent`,
-}
-
 var PARAMETERS = append(STATS, TUNABLES...)
 
 // A bcache (backing) device
 type Bcache_bdev struct {
-	BcacheDev  string   `json:"BcacheDev"`
-	ShortName  string   `json:"ShortName"`
-	BackingDev string   `json:"BackingDev"`
-	CacheDev   string   `json:"CacheDev"`
-	BUUID      string   `json:"BcacheDevUUID"`
-	CUUID      string   `json:"CacheSetUUID"`
-	Slaves     []string `json:"Devices"`
+	BcacheDev  string   `json:"BcacheDev" yaml:"BcacheDev"`
+	ShortName  string   `json:"ShortName" yaml:"ShortName"`
+	BackingDev string   `json:"BackingDev" yaml:"BackingDev"`
+	CacheDev   string   `json:"CacheDev" yaml:"CacheDev"`
+	BUUID      string   `json:"BcacheDevUUID" yaml:"BcacheDevUUID"`
+	CUUID      string   `json:"CacheSetUUID" yaml:"CacheSetUUID"`
+	Label      string   `json:"Label" yaml:"Label"`
+	Slaves     []string `json:"Devices" yaml:"Devices"`
+	// Holders, mounts and swap using the device, only filled in by 'show'
+	Holders []DeviceUser `json:"Holders,omitempty" yaml:"Holders,omitempty"`
 	// This map will contain extended info about bcache device, eg. stats, tunables etc
-	Parameters map[string]interface{}
+	Parameters map[string]interface{} `yaml:"Parameters"`
 }
 
 // A bcache cache device
 type Bcache_cdev struct {
-	Dev  string `json:"device"`
-	UUID string `json:"UUID"`
+	Dev  string `json:"device" yaml:"device"`
+	UUID string `json:"UUID" yaml:"UUID"`
 }
 
 // Struct to hold all bcache formatted devices
@@ -114,7 +106,16 @@ func (b *Bcache_bdev) Val(name string) (val string) {
 	//	}
 	//}
 	path = path + name
-	rawval_s := readVal(path)
+	return selectedVal(readVal(path))
+}
+
+// return current value of a sysfs attribute, the selected one for lists
+func ReadSysfs(path string) string {
+	return selectedVal(readVal(path))
+}
+
+// return the selected value from a sysfs list such as "writethrough [writeback] writearound none"
+func selectedVal(rawval_s string) (val string) {
 	if strings.Contains(rawval_s, `[`) {
 		rawval_a := strings.Split(rawval_s, " ")
 		if len(rawval_a) > 1 {
@@ -265,6 +266,7 @@ func (b *BcacheDevs) FindBDevs() (err error) {
 			b.FindCUUID()
 			b.BcacheDev = bcache_device
 			b.FindBUUID()
+			b.Label = readVal(SYSFS_BLOCK_ROOT + b.ShortName + `/bcache/label`)
 			b.MakeParameters(PARAMETERS)
 			c <- b
 		}(j, basedir)
@@ -314,6 +316,31 @@ func (b *BcacheDevs) IsCDevice(dev string) (ret bool, ret2 Bcache_cdev) {
 	return
 }
 
+// Find the registered backing device dev, in dry run mode a stand-in is returned for a
+// device that is not registered, as devices formatted by earlier steps of a dry run never are
+func (b *BcacheDevs) LookupBDevice(dev string) (Bcache_bdev, error) {
+	if x, bdev := b.IsBDevice(dev); x {
+		return bdev, nil
+	}
+	if DryRun() {
+		name := "<bcache device of " + dev + ">"
+		return Bcache_bdev{BcacheDev: name, ShortName: name, BackingDev: dev, CUUID: NONE_ATTACHED}, nil
+	}
+	return Bcache_bdev{}, errors.New(dev + " does not appear to be a formatted and registered BACKING device.")
+}
+
+// Find the registered cache device dev, in dry run mode a stand-in is returned for a
+// device that is not registered, see LookupBDevice
+func (b *BcacheDevs) LookupCDevice(dev string) (Bcache_cdev, error) {
+	if x, cdev := b.IsCDevice(dev); x {
+		return cdev, nil
+	}
+	if DryRun() {
+		return Bcache_cdev{Dev: dev, UUID: "<cache set uuid of " + dev + ">"}, nil
+	}
+	return Bcache_cdev{}, errors.New(dev + " does not appear to be a formatted and registered CACHE device.")
+}
+
 func (b *BcacheDevs) IsBCDevice(dev string) (ret bool) {
 	ret = false
 	if x, _ := b.IsBDevice(dev); x {
@@ -325,7 +352,7 @@ func (b *BcacheDevs) IsBCDevice(dev string) (ret bool) {
 }
 
 func Wipe(device string) (out string, err error) {
-	out, err = RunSystemCommand(`wipefs -a ` + device)
+	out, err = Exec.RunCommand(`wipefs -a ` + device)
 	return
 }
 
@@ -363,7 +390,7 @@ func (b *BcacheDevs) Format(newbdev string, newcdev string, wipe bool, writeback
 	if writeback {
 		bcache_cmd = bcache_cmd + " --writeback"
 	}
-	out, err := RunSystemCommand(bcache_cmd)
+	out, err := Exec.RunCommand(bcache_cmd)
 	if err == nil {
 		if newbdev != "" {
 			returnErr = Register(newbdev)
@@ -380,6 +407,9 @@ func (b *BcacheDevs) Format(newbdev string, newcdev string, wipe bool, writeback
 	if busy {
 		returnErr = errors.New("Device is busy - is it already a registered bcache dev or mounted?")
 	}
+	if returnErr == nil {
+		returnErr = errors.New(out + err.Error())
+	}
 	if already_formatted || existing_super {
 		returnErr = errors.New("An existing superblock was found on this block device, which means it is either an existing bcache device or has a filesystem on it. If you REALLY want to format this device, make sure it is not registered and use the --wipe-super flag (will erase ANY superblocks and filesystems!)\n")
 	}
@@ -406,8 +436,8 @@ func Register(device string) error {
 		if CheckSysfsFor(device) {
 			return nil
 		}
-		returnErr = ioutil.WriteFile(write_path, []byte(device), 0)
-		if returnErr != nil {
+		returnErr = Exec.WriteFile(write_path, device)
+		if returnErr != nil || DryRun() {
 			return returnErr
 		}
 		time.Sleep(time.Second * 1)
@@ -415,39 +445,27 @@ func Register(device string) error {
 	return errors.New("Couldn't register device. Is it a formatted bcache device?")
 }
 
-// Stop (unregister) a bcache device
+// Stop (unregister) a registered backing device or cache set and wait for it to disappear
+// from sysfs. A backing device that is still open (eg. mounted) stays in sysfs until it is
+// closed.
 func (b *BcacheDevs) Stop(device string) (returnErr error) {
-	var write_path string
-	sn := strings.Split(device, "/")
-	shortName := sn[len(sn)-1]
-	regexpString := `[0-9]+`
-	matched, err := regexp.Match(regexpString, []byte(shortName))
-	if err != nil {
-		returnErr = err
-		return
-	}
-	if matched {
-		topDev := strings.TrimRightFunc(shortName, func(r rune) bool {
-			return unicode.IsNumber(r)
-		})
-		write_path = SYSFS_BLOCK_ROOT + topDev + `/` + shortName
+	var write_path, sysfs_path string
+	if x, bdev := b.IsBDevice(device); x {
+		sysfs_path = SYSFS_BLOCK_ROOT + bdev.ShortName
+		write_path = sysfs_path + `/bcache/stop`
+	} else if x, cdev := b.IsCDevice(device); x {
+		sysfs_path = SYSFS_BCACHE_ROOT + cdev.UUID
+		write_path = sysfs_path + `/stop`
 	} else {
-		write_path = SYSFS_BLOCK_ROOT + shortName
-	}
-	sysfs_path := write_path
-	write_path = write_path + `/bcache/`
-	if x, _ := b.IsCDevice(device); x {
-		write_path = write_path + `set/`
+		return errors.New(device + " does not appear to be a registered bcache device.")
 	}
-	write_path += `stop`
 
-	err = ioutil.WriteFile(write_path, []byte{1}, 0)
-	if err != nil {
+	err := Exec.WriteFile(write_path, "1")
+	if err != nil || DryRun() {
 		returnErr = err
 		return
 	}
-	// wait up to 5 seconds for device to disappear, else exit without guarantees
-	sysfs_path = sysfs_path + `/bcache`
+	// wait up to 10 seconds for device to disappear, else exit without guarantees
 	for i := 0; i < 10; i++ {
 		if _, err := os.Stat(sysfs_path); os.IsNotExist(err) {
 			return
@@ -472,7 +490,7 @@ func (b *BcacheDevs) UnregisterBacking(device string) (returnErr error) {
 	var write_path string
 	if x, bdev := b.IsBDevice(device); x {
 		write_path = SYSFS_BLOCK_ROOT + bdev.ShortName + `/bcache/stop`
-		returnErr = ioutil.WriteFile(write_path, []byte{1}, 0)
+		returnErr = Exec.WriteFile(write_path, "1")
 	} else {
 		returnErr = errors.New(device + " does not appear to be a registered bcache BACKING device.")
 	}
@@ -482,7 +500,7 @@ func (b *BcacheDevs) UnregisterCache(device string) (returnErr error) {
 	var write_path string
 	if x, cdev := b.IsCDevice(device); x {
 		write_path = SYSFS_BCACHE_ROOT + cdev.UUID + `/stop`
-		returnErr = ioutil.WriteFile(write_path, []byte{1}, 0)
+		returnErr = Exec.WriteFile(write_path, "1")
 	} else {
 		returnErr = errors.New(device + " does not appear to be a registered bcache CACHE device.")
 	}
@@ -492,17 +510,19 @@ func (b *BcacheDevs) UnregisterCache(device string) (returnErr error) {
 // Attach cache device cdev to backing dev bdev. the bdev can be either an original system device
 // or a registered 'bcacheX' device
 func (b *BcacheDevs) Attach(cdev string, bdev string) (returnErr error) {
-	var x bool
-	var y Bcache_bdev
-	var z Bcache_cdev
-	if x, y = b.IsBDevice(bdev); !x {
-		return errors.New(bdev + " does not appear to be a formatted and registered BACKING device.")
+	y, err := b.LookupBDevice(bdev)
+	if err != nil {
+		return err
 	}
-	if x, z = b.IsCDevice(cdev); !x {
-		return errors.New(cdev + " does not appear to be a formatted and registered CACHE device.")
+	z, err := b.LookupCDevice(cdev)
+	if err != nil {
+		return err
 	}
 	write_path := SYSFS_BLOCK_ROOT + y.ShortName + `/bcache/attach`
-	ioutil.WriteFile(write_path, []byte(z.UUID), 0)
+	Exec.WriteFile(write_path, z.UUID)
+	if DryRun() {
+		return
+	}
 	y.FindCUUID()
 	if y.CUUID != z.UUID {
 		returnErr = errors.New("Cache device could not be attached. Is there already a cache set associated with the device?\n")
@@ -527,7 +547,7 @@ func (b *BcacheDevs) Detach(cdev string, bdev string) (returnErr error) {
 		return errors.New(bdev + " is not a registered backing device.")
 	}
 	writepath = writepath + z.ShortName + `/bcache/detach`
-	returnErr = ioutil.WriteFile(writepath, []byte(y.UUID), 0)
+	returnErr = Exec.WriteFile(writepath, y.UUID)
 	return
 }
 
@@ -557,6 +577,12 @@ func CheckSysfsFor(device string) bool {
 	return false
 }
 
+// Set the label of a bcache device
+func (b *Bcache_bdev) SetLabel(label string) error {
+	write_path := SYSFS_BLOCK_ROOT + b.ShortName + `/bcache/label`
+	return Exec.WriteFile(write_path, label)
+}
+
 // Check sysfs that bcache kernel module is loaded
 func BcacheModuleLoaded() bool {
 	if _, err := os.Stat(SYSFS_BCACHE_ROOT); os.IsNotExist(err) {
@@ -564,56 +590,3 @@ func BcacheModuleLoaded() bool {
 	}
 	return true
 }
-
-// Flush a single device. The only way to do this is to set the cache mode to adjust
-// the cache_mode and the writeback_delay. Return two errors, first is whether we actually
-// were able to complete the flush, second is setting mode back to writeback
-func (b *Bcache_bdev) FlushCache() (error, error) {
-	var err, err2 error
-	// First check if current mode is writeback
-	r := b.Val(`cache_mode`)
-	if r != "writeback" {
-		// nothing to flush
-		return nil, nil
-	}
-
-	// Set writeback_delay to something short
-	write_delay := b.Val(`writeback_delay`)
-	err = b.ChangeTunable(`writeback_delay`, `1`)
-	if err != nil {
-		return errors.New("error setting writeback_delay: " + err.Error()), nil
-	}
-
-	// To achieve flush, we set cachemode to writethrough until state is clean
-	err = b.ChangeTunable(`cache_mode`, `writethrough`)
-	if err != nil {
-		return errors.New("error setting writethrough for flush: " + err.Error()), nil
-	}
-	tries := 0
-	for {
-		if tries == 30 {
-			err = errors.New("could not complete flush within 30 seconds")
-			break
-		}
-		state := b.Val(`state`)
-		if state == `clean` {
-			err = nil
-			break
-		} else {
-			time.Sleep(1 * time.Second)
-		}
-		tries += 1
-	}
-
-	// If we called this function and got this far, cache mode must have been writeback, we change it back
-	err2 = b.ChangeTunable(`cache_mode`, `writeback`)
-	if err2 != nil {
-		err2 = errors.New("unable to set mode back to writeback: " + err2.Error())
-	}
-	// Set original writeback delay
-	err2 = b.ChangeTunable(`writeback_delay`, write_delay)
-	if err2 != nil {
-		err2 = errors.New("unable to set writeback_delay back to original value: " + err2.Error())
-	}
-	return err, err2
-}
@@ -0,0 +1,102 @@
+package bcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// A change made (or, in dry run mode, not made) to the system. Either a write of Value
+// to Path, or an external Command
+type Action struct {
+	Path    string `json:"path,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+func (a Action) String() string {
+	if a.Command != "" {
+		return "run: " + a.Command
+	}
+	return "write: " + a.Path + " <- " + a.Value
+}
+
+// Every change to devices goes through an Executor, so that changes can be recorded
+// and, in dry run mode, skipped
+type Executor struct {
+	DryRun bool
+	// if set, every change actually made is appended to the audit log
+	Audit   *AuditLog
+	mu      sync.Mutex
+	actions []Action
+}
+
+// The executor used by this package
+var Exec = new(Executor)
+
+// Check if changes are only being recorded
+func DryRun() bool {
+	return Exec.DryRun
+}
+
+func (e *Executor) record(a Action) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.actions = append(e.actions, a)
+}
+
+// All changes made (or intended, in dry run mode) so far
+func (e *Executor) Actions() []Action {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Action{}, e.actions...)
+}
+
+// Record a change and make it by calling f, unless in dry run mode
+func (e *Executor) Change(a Action, f func() error) error {
+	e.record(a)
+	if e.DryRun {
+		return nil
+	}
+	if e.Audit == nil {
+		return f()
+	}
+	entry := e.Audit.Entry(a)
+	err := f()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if auditErr := e.Audit.Write(entry); auditErr != nil {
+		fmt.Fprintln(os.Stderr, "warning: could not write audit log: "+auditErr.Error())
+	}
+	return err
+}
+
+// Write val to path, usually a sysfs attribute
+func (e *Executor) WriteFile(path string, val string) error {
+	return e.Change(Action{Path: path, Value: val}, func() error {
+		return ioutil.WriteFile(path, []byte(val), 0)
+	})
+}
+
+// Run a command that changes devices, see RunSystemCommand
+func (e *Executor) RunCommand(cmd string) (out string, err error) {
+	err = e.Change(Action{Command: cmd}, func() error {
+		out, err = RunSystemCommand(cmd)
+		return err
+	})
+	return
+}
+
+// Run a command with arguments that may contain spaces
+func (e *Executor) RunArgs(name string, args ...string) (out string, err error) {
+	err = e.Change(Action{Command: name + " " + strings.Join(args, " ")}, func() error {
+		out_b, err := exec.Command(name, args...).CombinedOutput()
+		out = string(out_b)
+		return err
+	})
+	return
+}
@@ -0,0 +1,333 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways of flushing dirty data, each changes a few tunables and restores them afterwards
+const (
+	// Stop caching writes, reads are still cached
+	FLUSH_WRITETHROUGH = "writethrough"
+	// Stay in writeback mode and write back as fast as possible, new writes are still cached
+	FLUSH_DRAIN = "drain"
+	// Writes bypass the cache so nothing new is dirtied, reads are still cached
+	FLUSH_WRITEAROUND = "writearound"
+)
+
+var FLUSH_STRATEGIES = []string{FLUSH_WRITETHROUGH, FLUSH_DRAIN, FLUSH_WRITEAROUND}
+
+// Default writeback_rate_minimum of the drain strategy in sectors/second (1GiB/s), the
+// backing device is the limit rather than the rate controller
+const FLUSH_DRAIN_RATE = `2097152`
+
+// Settings changed by a flush are recorded here before they are changed, so an
+// interrupted flush can be undone with 'bcachectl flush --recover'
+const FLUSH_JOURNAL_DIR = `/var/lib/bcachectl/flush/`
+
+type FlushOptions struct {
+	Strategy string
+	// Give up after this long, 0 waits until the device is clean
+	Timeout time.Duration
+	// writeback_rate_minimum (sectors/second) of the drain strategy, FLUSH_DRAIN_RATE if empty
+	DrainRate string
+	// Called about every second while waiting for the device to be clean
+	Progress func(FlushProgress)
+}
+
+type FlushProgress struct {
+	Device  string
+	Dirty   uint64
+	Elapsed time.Duration
+	// Bytes written back per second, 0 until known
+	Rate float64
+	// Estimated time left, -1 until known
+	ETA time.Duration
+}
+
+// Original settings of a device while a flush is running
+type FlushJournal struct {
+	Device   string      `yaml:"device"`
+	BUUID    string      `yaml:"buuid"`
+	Strategy string      `yaml:"strategy"`
+	Started  time.Time   `yaml:"started"`
+	Original DriveConfig `yaml:"original"`
+}
+
+func NewFlushOptions() FlushOptions {
+	return FlushOptions{Strategy: FLUSH_WRITETHROUGH, DrainRate: FLUSH_DRAIN_RATE}
+}
+
+// Tunables a strategy sets during the flush
+func flushSettings(opts FlushOptions) (DriveConfig, error) {
+	switch opts.Strategy {
+	case FLUSH_WRITETHROUGH, "":
+		return DriveConfig{`writeback_delay`: `1`, `cache_mode`: `writethrough`}, nil
+	case FLUSH_WRITEAROUND:
+		return DriveConfig{`writeback_delay`: `1`, `cache_mode`: `writearound`}, nil
+	case FLUSH_DRAIN:
+		rate := opts.DrainRate
+		if rate == "" {
+			rate = FLUSH_DRAIN_RATE
+		}
+		sectors, err := strconv.ParseInt(rate, 10, 64)
+		if err != nil || sectors < 1 {
+			return nil, errors.New("invalid drain rate " + rate + ", expecting sectors/second")
+		}
+		// with writeback_percent at 0 the rate controller stops adjusting writeback_rate,
+		// so the rate is raised directly as well as its minimum
+		return DriveConfig{
+			`writeback_delay`:        `1`,
+			`writeback_percent`:      `0`,
+			`writeback_rate_minimum`: rate,
+			`writeback_rate`:         strconv.FormatInt(sectors*512, 10),
+		}, nil
+	}
+	return nil, errors.New("unknown flush strategy: " + opts.Strategy + " (expecting " + strings.Join(FLUSH_STRATEGIES, ", ") + ")")
+}
+
+func flushJournalPath(buuid string) string {
+	return FLUSH_JOURNAL_DIR + buuid + `.yaml`
+}
+
+func (j *FlushJournal) save() error {
+	if DryRun() {
+		return nil
+	}
+	if err := os.MkdirAll(FLUSH_JOURNAL_DIR, 0750); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(flushJournalPath(j.BUUID), out, 0640)
+}
+
+func (j *FlushJournal) remove() error {
+	if DryRun() {
+		return nil
+	}
+	return os.Remove(flushJournalPath(j.BUUID))
+}
+
+// Journals left behind by interrupted flushes
+func FlushJournals() (journals []FlushJournal, err error) {
+	entries, err := os.ReadDir(FLUSH_JOURNAL_DIR)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), `.yaml`) {
+			continue
+		}
+		f, err := os.ReadFile(FLUSH_JOURNAL_DIR + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		var j FlushJournal
+		if err = yaml.Unmarshal(f, &j); err != nil {
+			return nil, errors.New("could not read flush journal " + entry.Name() + ": " + err.Error())
+		}
+		journals = append(journals, j)
+	}
+	return
+}
+
+// Dirty data of the device in bytes
+func (b *Bcache_bdev) DirtyBytes() uint64 {
+	n, _ := strconv.ParseUint(HumanToBytes(b.Val(`dirty_data`)), 10, 64)
+	return n
+}
+
+// Put back the settings recorded in a journal
+func (b *Bcache_bdev) restoreSettings(original DriveConfig) (err error) {
+	for _, tunable := range orderedTunables(original) {
+		if e := b.Tune(tunable + `:` + original[tunable]); e != nil && err == nil {
+			err = errors.New("unable to set " + tunable + " back to " + original[tunable] + ": " + e.Error())
+		}
+	}
+	return
+}
+
+// Flush the dirty data of a device with the given strategy and restore the changed settings
+// afterwards, also when ctx is cancelled. The settings are recorded in a journal first, so
+// they can be restored with RecoverFlushes if bcachectl dies. Returns two errors, first is
+// whether the flush completed, second is restoring the original settings.
+func (b *Bcache_bdev) Flush(ctx context.Context, opts FlushOptions) (error, error) {
+	settings, err := flushSettings(opts)
+	if err != nil {
+		return err, nil
+	}
+	if s := b.Val(`state`); s != `dirty` {
+		// nothing to flush
+		return nil, nil
+	}
+	if _, err := os.Stat(flushJournalPath(b.BUUID)); err == nil {
+		return errors.New("an interrupted flush of " + b.ShortName + " left settings to restore, run 'bcachectl flush --recover' first"), nil
+	}
+	j := FlushJournal{
+		Device:   b.ShortName,
+		BUUID:    b.BUUID,
+		Strategy: opts.Strategy,
+		Started:  time.Now(),
+		Original: make(DriveConfig),
+	}
+	for tunable := range settings {
+		j.Original[tunable] = b.Val(tunable)
+	}
+	if err = j.save(); err != nil {
+		return errors.New("could not write flush journal: " + err.Error()), nil
+	}
+
+	var flushErr error
+	for _, tunable := range orderedTunables(settings) {
+		if flushErr = b.Tune(tunable + `:` + settings[tunable]); flushErr != nil {
+			flushErr = errors.New("error setting " + tunable + " for flush: " + flushErr.Error())
+			break
+		}
+	}
+	if flushErr == nil {
+		flushErr = b.waitClean(ctx, opts)
+	}
+
+	restoreErr := b.restoreSettings(j.Original)
+	if restoreErr == nil {
+		if err = j.remove(); err != nil {
+			restoreErr = errors.New("settings were restored but the flush journal could not be removed: " + err.Error())
+		}
+	}
+	return flushErr, restoreErr
+}
+
+// Poll the device until it is clean, reporting progress
+func (b *Bcache_bdev) waitClean(ctx context.Context, opts FlushOptions) error {
+	return b.waitState(ctx, opts, "flush", func(state string) bool {
+		return state != `dirty`
+	})
+}
+
+// Poll the state of the device until done returns true, reporting the progress of
+// writing back dirty data. what names the operation in errors.
+func (b *Bcache_bdev) waitState(ctx context.Context, opts FlushOptions, what string, done func(string) bool) error {
+	start := time.Now()
+	lastDirty := b.DirtyBytes()
+	lastTime := start
+	var rate float64
+	for !DryRun() {
+		if done(b.Val(`state`)) {
+			return nil
+		}
+		dirty := b.DirtyBytes()
+		now := time.Now()
+		if elapsed := now.Sub(lastTime).Seconds(); elapsed >= 1 {
+			sample := (float64(lastDirty) - float64(dirty)) / elapsed
+			if sample < 0 {
+				sample = 0
+			}
+			// smooth the rate, writeback is bursty
+			if rate == 0 {
+				rate = sample
+			} else {
+				rate = 0.7*rate + 0.3*sample
+			}
+			lastDirty = dirty
+			lastTime = now
+		}
+		if opts.Progress != nil {
+			p := FlushProgress{Device: b.ShortName, Dirty: dirty, Elapsed: now.Sub(start), Rate: rate, ETA: -1}
+			if rate > 0 {
+				p.ETA = time.Duration(float64(dirty) / rate * float64(time.Second))
+			}
+			opts.Progress(p)
+		}
+		if opts.Timeout > 0 && now.Sub(start) >= opts.Timeout {
+			return errors.New("could not complete " + what + " within " + opts.Timeout.String() + ", " + BytesToHuman(dirty) + " dirty data left")
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New(what + " interrupted, " + BytesToHuman(dirty) + " dirty data left")
+		case <-time.After(1 * time.Second):
+		}
+	}
+	return nil
+}
+
+// Restore the settings of every interrupted flush, returns the devices restored. Journals
+// of devices that are not registered are kept and reported in the error.
+func (b *BcacheDevs) RecoverFlushes() (recovered []string, err error) {
+	journals, err := FlushJournals()
+	if err != nil {
+		return
+	}
+	var missing []string
+	for _, j := range journals {
+		found := false
+		for _, bdev := range b.Bdevs {
+			if bdev.BUUID != j.BUUID {
+				continue
+			}
+			found = true
+			if err = bdev.restoreSettings(j.Original); err != nil {
+				return recovered, errors.New(bdev.ShortName + ": " + err.Error())
+			}
+			if err = j.remove(); err != nil {
+				return
+			}
+			recovered = append(recovered, bdev.ShortName)
+		}
+		if !found {
+			missing = append(missing, j.Device+" ("+j.BUUID+")")
+		}
+	}
+	if len(missing) > 0 {
+		err = errors.New("devices of interrupted flushes are not registered: " + strings.Join(missing, ", "))
+	}
+	return
+}
+
+// Detach a backing device from its cache set once it has no dirty data. A dirty device is
+// flushed first when flush is set, detached anyway when force is set (the kernel then writes
+// back the dirty data before completing the detach) and refused otherwise. Waits until the
+// device reports 'no cache', opts sets the flush strategy, timeout and progress callback.
+func (b *BcacheDevs) SafeDetach(ctx context.Context, cdev string, bdev string, flush bool, force bool, opts FlushOptions) error {
+	x, y := b.IsCDevice(cdev)
+	if !x {
+		return errors.New(cdev + " is not a registered cache device.")
+	}
+	x, z := b.IsBDevice(bdev)
+	if !x {
+		return errors.New(bdev + " is not a registered backing device.")
+	}
+	if z.CUUID != y.UUID {
+		return errors.New(z.ShortName + " is not attached to cache set " + y.UUID)
+	}
+	if z.Val(`state`) == `dirty` {
+		if flush {
+			flushErr, restoreErr := z.Flush(ctx, opts)
+			if flushErr != nil {
+				return errors.New("could not flush " + z.ShortName + " before detaching: " + flushErr.Error())
+			}
+			if restoreErr != nil {
+				return errors.New("flushed " + z.ShortName + " but could not reset its settings: " + restoreErr.Error())
+			}
+		} else if !force {
+			return errors.New(z.ShortName + " has " + z.Val(`dirty_data`) + " of dirty data (cache mode " + z.Val(`cache_mode`) +
+				"), use --flush to flush it first or --force to detach anyway (the kernel writes back dirty data before the detach completes)")
+		}
+	}
+	if err := b.Detach(cdev, bdev); err != nil {
+		return err
+	}
+	if err := z.waitState(ctx, opts, "detach", func(state string) bool {
+		return state == NONE_ATTACHED
+	}); err != nil {
+		return errors.New(err.Error() + ", the kernel continues the detach in the background")
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package bcache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// Minimal GPT support, enough to add labelled partitions to a disk without sgdisk/partx
+const (
+	gptSignature   = "EFI PART"
+	gptRevision    = 0x00010000
+	gptHeaderSize  = 92
+	gptNumEntries  = 128
+	gptEntrySize   = 128
+	gptAlignBytes  = 1024 * 1024
+	blkpg          = 0x1269
+	blkpgAddPart   = 1
+	blkpgDelPart   = 2
+	GPT_LINUX_DATA = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+// A partition entry in a GPT
+type GptPartition struct {
+	Number   int
+	Type     [16]byte
+	GUID     [16]byte
+	FirstLBA uint64
+	LastLBA  uint64
+	Attrs    uint64
+	Name     string
+}
+
+// Partition table of a whole disk
+type GptTable struct {
+	Device     string
+	SectorSize uint64
+	LastLBA    uint64
+	DiskGUID   [16]byte
+	Partitions []GptPartition
+	// set when there was no GPT on the disk and a protective MBR must be written
+	fresh bool
+}
+
+// Region of unpartitioned sectors
+type GptFree struct {
+	FirstLBA uint64
+	LastLBA  uint64
+}
+
+// Convert a textual GUID to its on-disk (mixed endian) representation
+func ParseGUID(s string) (guid [16]byte, err error) {
+	h := strings.ReplaceAll(s, "-", "")
+	if len(h) != 32 {
+		return guid, errors.New("invalid guid: " + s)
+	}
+	var raw [16]byte
+	for i := 0; i < 16; i++ {
+		v, err := strconv.ParseUint(h[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return guid, errors.New("invalid guid: " + s)
+		}
+		raw[i] = byte(v)
+	}
+	guid = raw
+	guid[0], guid[1], guid[2], guid[3] = raw[3], raw[2], raw[1], raw[0]
+	guid[4], guid[5] = raw[5], raw[4]
+	guid[6], guid[7] = raw[7], raw[6]
+	return
+}
+
+func randomGUID() (guid [16]byte) {
+	rand.Read(guid[:])
+	guid[7] = (guid[7] & 0x0f) | 0x40
+	guid[8] = (guid[8] & 0x3f) | 0x80
+	return
+}
+
+// Size of a block device in bytes and its logical sector size
+func diskGeometry(f *os.File, dev string) (size uint64, sectorSize uint64, err error) {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	size = uint64(end)
+	sectorSize = 512
+	ss := readVal(SYSFS_BLOCK_ROOT + filepath.Base(dev) + `/queue/logical_block_size`)
+	if n, err2 := strconv.ParseUint(ss, 10, 64); err2 == nil && n > 0 {
+		sectorSize = n
+	}
+	return
+}
+
+func (t *GptTable) entrySectors() uint64 {
+	return (gptNumEntries*gptEntrySize + t.SectorSize - 1) / t.SectorSize
+}
+
+func (t *GptTable) FirstUsableLBA() uint64 {
+	return 2 + t.entrySectors()
+}
+
+func (t *GptTable) LastUsableLBA() uint64 {
+	return t.LastLBA - 1 - t.entrySectors()
+}
+
+func (t *GptTable) alignSectors() uint64 {
+	return gptAlignBytes / t.SectorSize
+}
+
+// Read the GPT of a disk. If the disk has no partition table at all, an empty table is
+// returned which will be created on Write. If wipe is set, any existing table is ignored.
+func ReadGPT(dev string, wipe bool) (t *GptTable, err error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	size, ss, err := diskGeometry(f, dev)
+	if err != nil {
+		return
+	}
+	t = &GptTable{Device: dev, SectorSize: ss, LastLBA: size/ss - 1}
+	if t.LastLBA < t.FirstUsableLBA()+2*t.alignSectors() {
+		return nil, errors.New(dev + " is too small to partition")
+	}
+	if wipe {
+		t.fresh = true
+		t.DiskGUID = randomGUID()
+		return
+	}
+	mbr := make([]byte, ss)
+	if _, err = f.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, ss)
+	if _, err = f.ReadAt(hdr, int64(ss)); err != nil {
+		return nil, err
+	}
+	if string(hdr[0:8]) != gptSignature {
+		if mbr[510] == 0x55 && mbr[511] == 0xaa && mbr[450] != 0 {
+			return nil, errors.New(dev + " has an MBR partition table, only GPT is supported (use --wipe-table to replace it)")
+		}
+		t.fresh = true
+		t.DiskGUID = randomGUID()
+		return
+	}
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:16])
+	if hdrSize < gptHeaderSize || uint64(hdrSize) > ss {
+		return nil, errors.New(dev + " has an invalid GPT header")
+	}
+	crc := binary.LittleEndian.Uint32(hdr[16:20])
+	check := make([]byte, hdrSize)
+	copy(check, hdr[:hdrSize])
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	if crc32.ChecksumIEEE(check) != crc {
+		return nil, errors.New(dev + " has a corrupt GPT header")
+	}
+	copy(t.DiskGUID[:], hdr[56:72])
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:80])
+	numEntries := binary.LittleEndian.Uint32(hdr[80:84])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+	if entrySize < gptEntrySize || numEntries > gptNumEntries {
+		return nil, errors.New(dev + " has an unsupported GPT layout")
+	}
+	entries := make([]byte, uint64(numEntries)*uint64(entrySize))
+	if _, err = f.ReadAt(entries, int64(entriesLBA*ss)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:92]) {
+		return nil, errors.New(dev + " has a corrupt GPT partition array")
+	}
+	var empty [16]byte
+	for i := 0; i < int(numEntries); i++ {
+		e := entries[i*int(entrySize) : (i+1)*int(entrySize)]
+		var p GptPartition
+		copy(p.Type[:], e[0:16])
+		if p.Type == empty {
+			continue
+		}
+		p.Number = i + 1
+		copy(p.GUID[:], e[16:32])
+		p.FirstLBA = binary.LittleEndian.Uint64(e[32:40])
+		p.LastLBA = binary.LittleEndian.Uint64(e[40:48])
+		p.Attrs = binary.LittleEndian.Uint64(e[48:56])
+		var name []uint16
+		for j := 56; j+1 < 128; j += 2 {
+			c := binary.LittleEndian.Uint16(e[j : j+2])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		p.Name = string(utf16.Decode(name))
+		t.Partitions = append(t.Partitions, p)
+	}
+	return
+}
+
+// Find a partition by its GPT name (partlabel)
+func (t *GptTable) FindByName(name string) (found bool, part GptPartition) {
+	for _, p := range t.Partitions {
+		if p.Name == name {
+			return true, p
+		}
+	}
+	return
+}
+
+// Return the unpartitioned regions of the disk, aligned to 1MiB
+func (t *GptTable) FreeRegions() (free []GptFree) {
+	parts := make([]GptPartition, len(t.Partitions))
+	copy(parts, t.Partitions)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].FirstLBA < parts[j].FirstLBA })
+	align := t.alignSectors()
+	next := t.FirstUsableLBA()
+	last := t.LastUsableLBA()
+	add := func(first uint64, end uint64) {
+		first = (first + align - 1) / align * align
+		if first <= end && end-first+1 >= align {
+			free = append(free, GptFree{FirstLBA: first, LastLBA: end})
+		}
+	}
+	for _, p := range parts {
+		if p.FirstLBA > next {
+			add(next, p.FirstLBA-1)
+		}
+		if p.LastLBA+1 > next {
+			next = p.LastLBA + 1
+		}
+	}
+	if next <= last {
+		add(next, last)
+	}
+	return
+}
+
+// Add a Linux data partition of (at most) size bytes in the first free region big enough
+// to hold it. The size is rounded down to the 1MiB alignment.
+func (t *GptTable) AddPartition(name string, size uint64) (part GptPartition, err error) {
+	if len(utf16.Encode([]rune(name))) > 36 {
+		return part, errors.New("partition name too long: " + name)
+	}
+	align := t.alignSectors()
+	sectors := size / t.SectorSize / align * align
+	if sectors == 0 {
+		return part, errors.New("partition " + name + " would be smaller than 1MiB")
+	}
+	used := make(map[int]bool)
+	for _, p := range t.Partitions {
+		used[p.Number] = true
+	}
+	for n := 1; n <= gptNumEntries; n++ {
+		if !used[n] {
+			part.Number = n
+			break
+		}
+	}
+	if part.Number == 0 {
+		return part, errors.New(t.Device + " has no free partition entries")
+	}
+	for _, r := range t.FreeRegions() {
+		if r.LastLBA-r.FirstLBA+1 >= sectors {
+			part.FirstLBA = r.FirstLBA
+			part.LastLBA = r.FirstLBA + sectors - 1
+			break
+		}
+	}
+	if part.LastLBA == 0 {
+		return part, errors.New("not enough free space on " + t.Device + " for " + name + " (" + BytesToHuman(size) + ")")
+	}
+	part.Type, _ = ParseGUID(GPT_LINUX_DATA)
+	part.GUID = randomGUID()
+	part.Name = name
+	t.Partitions = append(t.Partitions, part)
+	return
+}
+
+// Size of a partition in bytes
+func (t *GptTable) PartitionSize(p GptPartition) uint64 {
+	return (p.LastLBA - p.FirstLBA + 1) * t.SectorSize
+}
+
+// Device node of partition number n of the disk, eg. /dev/sdb1 or /dev/nvme0n1p1
+func (t *GptTable) PartitionDev(n int) string {
+	if unicode.IsDigit(rune(t.Device[len(t.Device)-1])) {
+		return fmt.Sprintf("%sp%d", t.Device, n)
+	}
+	return fmt.Sprintf("%s%d", t.Device, n)
+}
+
+func (t *GptTable) header(entries []byte, primary bool) []byte {
+	h := make([]byte, t.SectorSize)
+	copy(h[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(h[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(h[12:16], gptHeaderSize)
+	my, alt, entriesLBA := uint64(1), t.LastLBA, uint64(2)
+	if !primary {
+		my, alt, entriesLBA = t.LastLBA, 1, t.LastLBA-t.entrySectors()
+	}
+	binary.LittleEndian.PutUint64(h[24:32], my)
+	binary.LittleEndian.PutUint64(h[32:40], alt)
+	binary.LittleEndian.PutUint64(h[40:48], t.FirstUsableLBA())
+	binary.LittleEndian.PutUint64(h[48:56], t.LastUsableLBA())
+	copy(h[56:72], t.DiskGUID[:])
+	binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:84], gptNumEntries)
+	binary.LittleEndian.PutUint32(h[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(h[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:gptHeaderSize]))
+	return h
+}
+
+func (t *GptTable) entries() []byte {
+	entries := make([]byte, t.entrySectors()*t.SectorSize)
+	for _, p := range t.Partitions {
+		e := entries[(p.Number-1)*gptEntrySize : p.Number*gptEntrySize]
+		copy(e[0:16], p.Type[:])
+		copy(e[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:40], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:48], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:56], p.Attrs)
+		for i, c := range utf16.Encode([]rune(p.Name)) {
+			binary.LittleEndian.PutUint16(e[56+i*2:58+i*2], c)
+		}
+	}
+	return entries[:gptNumEntries*gptEntrySize]
+}
+
+func (t *GptTable) protectiveMBR() []byte {
+	mbr := make([]byte, t.SectorSize)
+	p := mbr[446:462]
+	p[1], p[2], p[3] = 0x00, 0x02, 0x00
+	p[4] = 0xee
+	p[5], p[6], p[7] = 0xff, 0xff, 0xff
+	binary.LittleEndian.PutUint32(p[8:12], 1)
+	size := t.LastLBA
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(p[12:16], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// Write primary and backup GPT (and a protective MBR for a new table) to the disk
+func (t *GptTable) Write() (err error) {
+	f, err := os.OpenFile(t.Device, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	entries := t.entries()
+	padded := make([]byte, t.entrySectors()*t.SectorSize)
+	copy(padded, entries)
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{2, padded},
+		{1, t.header(entries, true)},
+		{t.LastLBA - t.entrySectors(), padded},
+		{t.LastLBA, t.header(entries, false)},
+	}
+	if t.fresh {
+		writes = append([]struct {
+			lba  uint64
+			data []byte
+		}{{0, t.protectiveMBR()}}, writes...)
+	}
+	for _, w := range writes {
+		if _, err = f.WriteAt(w.data, int64(w.lba*t.SectorSize)); err != nil {
+			return
+		}
+	}
+	return f.Sync()
+}
+
+type blkpgPartition struct {
+	Start   int64
+	Length  int64
+	Pno     int32
+	Devname [64]byte
+	Volname [64]byte
+}
+
+type blkpgIoctlArg struct {
+	Op      int32
+	Flags   int32
+	Datalen int32
+	Data    unsafe.Pointer
+}
+
+func blkpgIoctl(f *os.File, op int32, part blkpgPartition) syscall.Errno {
+	arg := blkpgIoctlArg{
+		Op:      op,
+		Datalen: int32(unsafe.Sizeof(part)),
+		Data:    unsafe.Pointer(&part),
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkpg, uintptr(unsafe.Pointer(&arg)))
+	return errno
+}
+
+// Tell the kernel about a new partition (equivalent of `partx -a`), existing partitions on
+// the disk may stay in use
+func (t *GptTable) AddToKernel(p GptPartition) error {
+	f, err := os.Open(t.Device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part := blkpgPartition{
+		Start:  int64(p.FirstLBA * t.SectorSize),
+		Length: int64(t.PartitionSize(p)),
+		Pno:    int32(p.Number),
+	}
+	errno := blkpgIoctl(f, blkpgAddPart, part)
+	if errno == syscall.EBUSY {
+		// kernel still knows a stale partition with this number (eg. after --wipe-table)
+		if errno = blkpgIoctl(f, blkpgDelPart, part); errno == 0 {
+			errno = blkpgIoctl(f, blkpgAddPart, part)
+		}
+	}
+	if errno != 0 {
+		return errors.New("could not add partition " + t.PartitionDev(p.Number) + " to kernel: " + errno.Error())
+	}
+	return nil
+}
+
+// Remove the partitions the kernel knows of but which are not in the table any more, eg.
+// after the table was replaced (equivalent of `partx -d`)
+func (t *GptTable) RemoveStaleFromKernel() error {
+	keep := make(map[int]bool)
+	for _, p := range t.Partitions {
+		keep[p.Number] = true
+	}
+	var stale []int
+	disk := blockName(t.Device)
+	for _, name := range withPartitions(disk) {
+		n, err := strconv.Atoi(readVal(SYSFS_CLASS_BLOCK + disk + `/` + name + `/partition`))
+		if err == nil && !keep[n] {
+			stale = append(stale, n)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	f, err := os.Open(t.Device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, n := range stale {
+		if errno := blkpgIoctl(f, blkpgDelPart, blkpgPartition{Pno: int32(n)}); errno != 0 && errno != syscall.ENXIO {
+			return errors.New("could not remove stale partition " + t.PartitionDev(n) + " from kernel: " + errno.Error())
+		}
+	}
+	return nil
+}
+
+// Write the table, tell the kernel about the newly added partitions and wait for their
+// device nodes to appear
+func (t *GptTable) Commit(created []GptPartition) (err error) {
+	if len(created) == 0 {
+		return
+	}
+	var names []string
+	for _, p := range created {
+		names = append(names, p.Name+"="+t.PartitionDev(p.Number)+" ("+BytesToHuman(t.PartitionSize(p))+")")
+	}
+	err = Exec.Change(Action{Path: t.Device, Value: "GPT adding partitions " + strings.Join(names, ", ")}, func() error {
+		if err := t.Write(); err != nil {
+			return err
+		}
+		if err := t.RemoveStaleFromKernel(); err != nil {
+			return err
+		}
+		for _, p := range created {
+			if err := t.AddToKernel(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || DryRun() {
+		return
+	}
+	for _, p := range created {
+		dev := t.PartitionDev(p.Number)
+		for i := 0; ; i++ {
+			if _, err := os.Stat(dev); err == nil {
+				break
+			}
+			if i == 10 {
+				return errors.New("partition " + dev + " did not appear")
+			}
+			time.Sleep(time.Second * 1)
+		}
+	}
+	return
+}
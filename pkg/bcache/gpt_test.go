@@ -0,0 +1,228 @@
+package bcache
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDiskSize = 64 << 20
+
+// A sparse file standing in for an empty disk, sectors are 512 bytes as it has no sysfs entry
+func testDisk(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(testDiskSize); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readSector(t *testing.T, path string, lba uint64, n uint64) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, n*512)
+	if _, err = f.ReadAt(buf, int64(lba*512)); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// Check the CRCs of a header and its partition array, returns the header
+func checkHeader(t *testing.T, path string, lba uint64) []byte {
+	hdr := readSector(t, path, lba, 1)
+	if string(hdr[0:8]) != gptSignature {
+		t.Fatalf("no GPT signature at LBA %d", lba)
+	}
+	check := make([]byte, gptHeaderSize)
+	copy(check, hdr[:gptHeaderSize])
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	if crc := binary.LittleEndian.Uint32(hdr[16:20]); crc32.ChecksumIEEE(check) != crc {
+		t.Errorf("header CRC at LBA %d is %08x, expected %08x", lba, crc, crc32.ChecksumIEEE(check))
+	}
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:80])
+	entries := readSector(t, path, entriesLBA, gptNumEntries*gptEntrySize/512)
+	if crc := binary.LittleEndian.Uint32(hdr[88:92]); crc32.ChecksumIEEE(entries) != crc {
+		t.Errorf("partition array CRC of header at LBA %d is %08x, expected %08x", lba, crc, crc32.ChecksumIEEE(entries))
+	}
+	return hdr
+}
+
+func TestParseGUID(t *testing.T) {
+	guid, err := ParseGUID(GPT_LINUX_DATA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [16]byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	if guid != want {
+		t.Errorf("got % x, want % x", guid, want)
+	}
+	if _, err = ParseGUID("0FC63DAF-8483"); err == nil {
+		t.Error("expected a short guid to be refused")
+	}
+}
+
+func TestGptRoundTrip(t *testing.T) {
+	path := testDisk(t)
+	table, err := ReadGPT(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table.Partitions) != 0 || table.LastLBA != testDiskSize/512-1 {
+		t.Fatalf("unexpected empty table: %d partitions, last LBA %d", len(table.Partitions), table.LastLBA)
+	}
+	for _, p := range []struct {
+		name string
+		size uint64
+	}{{"sdb_cache", 10 << 20}, {"sdc_cache", 5<<20 + 1000}} {
+		if _, err = table.AddPartition(p.name, p.size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = table.Write(); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadGPT(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.DiskGUID != table.DiskGUID {
+		t.Errorf("disk guid changed from % x to % x", table.DiskGUID, read.DiskGUID)
+	}
+	if len(read.Partitions) != len(table.Partitions) {
+		t.Fatalf("wrote %d partitions, read %d", len(table.Partitions), len(read.Partitions))
+	}
+	for i, p := range read.Partitions {
+		if p != table.Partitions[i] {
+			t.Errorf("partition %d\n got: %+v\nwant: %+v", i+1, p, table.Partitions[i])
+		}
+	}
+	if found, p := read.FindByName("sdc_cache"); !found || read.PartitionSize(p) != 5<<20 {
+		t.Errorf("expected sdc_cache rounded down to 5MiB, got %v %d", found, read.PartitionSize(p))
+	}
+	if dev := read.PartitionDev(2); dev != path+"2" {
+		t.Errorf("partition device %s", dev)
+	}
+}
+
+func TestGptHeaders(t *testing.T) {
+	path := testDisk(t)
+	table, err := ReadGPT(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddPartition("sdb_cache", 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Write(); err != nil {
+		t.Fatal(err)
+	}
+	last := uint64(testDiskSize/512 - 1)
+	primary := checkHeader(t, path, 1)
+	backup := checkHeader(t, path, last)
+	for _, c := range []struct {
+		what string
+		got  uint64
+		want uint64
+	}{
+		{"primary my LBA", binary.LittleEndian.Uint64(primary[24:32]), 1},
+		{"primary alternate LBA", binary.LittleEndian.Uint64(primary[32:40]), last},
+		{"primary entries LBA", binary.LittleEndian.Uint64(primary[72:80]), 2},
+		{"backup my LBA", binary.LittleEndian.Uint64(backup[24:32]), last},
+		{"backup alternate LBA", binary.LittleEndian.Uint64(backup[32:40]), 1},
+		{"backup entries LBA", binary.LittleEndian.Uint64(backup[72:80]), last - 32},
+		{"first usable LBA", binary.LittleEndian.Uint64(primary[40:48]), 34},
+		{"last usable LBA", binary.LittleEndian.Uint64(primary[48:56]), last - 33},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s is %d, expected %d", c.what, c.got, c.want)
+		}
+	}
+	mbr := readSector(t, path, 0, 1)
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		t.Error("protective MBR has no boot signature")
+	}
+	if mbr[446+4] != 0xee || binary.LittleEndian.Uint32(mbr[446+8:446+12]) != 1 || binary.LittleEndian.Uint32(mbr[446+12:446+16]) != uint32(last) {
+		t.Errorf("unexpected protective MBR partition % x", mbr[446:462])
+	}
+}
+
+func TestGptCorruptHeader(t *testing.T) {
+	path := testDisk(t)
+	table, err := ReadGPT(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddPartition("sdb_cache", 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Write(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first usable LBA is covered by the header CRC
+	if _, err = f.WriteAt([]byte{0xff}, 512+40); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = ReadGPT(path, false); err == nil || !strings.Contains(err.Error(), "corrupt GPT header") {
+		t.Errorf("expected a corrupt header error, got %v", err)
+	}
+	if table, err = ReadGPT(path, true); err != nil || len(table.Partitions) != 0 {
+		t.Errorf("expected wipe to ignore the corrupt table, got %v", err)
+	}
+}
+
+func TestGptAlignment(t *testing.T) {
+	table, err := ReadGPT(testDisk(t), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	align := uint64(gptAlignBytes / 512)
+	if free := table.FreeRegions(); len(free) != 1 || free[0].FirstLBA != align {
+		t.Fatalf("expected one free region starting at 1MiB, got %+v", free)
+	}
+	for _, size := range []uint64{3<<20 + 512, 1 << 20, 7 << 20} {
+		if _, err = table.AddPartition("p", size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// leave a gap, the next partition that fits must go into it
+	table.Partitions = append(table.Partitions[:1], table.Partitions[2:]...)
+	p, err := table.AddPartition("gap", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Number != 2 || p.FirstLBA != 4*align {
+		t.Errorf("expected partition 2 in the gap at 4MiB, got number %d at LBA %d", p.Number, p.FirstLBA)
+	}
+	for _, p := range table.Partitions {
+		if p.FirstLBA%align != 0 || (p.LastLBA+1)%align != 0 {
+			t.Errorf("partition %d (%d-%d) is not aligned to 1MiB", p.Number, p.FirstLBA, p.LastLBA)
+		}
+	}
+	for _, r := range table.FreeRegions() {
+		if r.FirstLBA%align != 0 || r.LastLBA > table.LastUsableLBA() {
+			t.Errorf("free region %d-%d is not aligned or beyond the last usable LBA", r.FirstLBA, r.LastLBA)
+		}
+	}
+	if _, err = table.AddPartition("tiny", 512<<10); err == nil {
+		t.Error("expected a partition smaller than 1MiB to be refused")
+	}
+	if _, err = table.AddPartition("huge", testDiskSize); err == nil {
+		t.Error("expected a partition larger than the free space to be refused")
+	}
+}
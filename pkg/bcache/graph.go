@@ -0,0 +1,138 @@
+package bcache
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Graph output formats
+const (
+	GRAPH_DOT     = "dot"
+	GRAPH_MERMAID = "mermaid"
+)
+
+type graphNode struct {
+	ID    string
+	Lines []string
+	Shape string
+}
+
+type graphEdge struct {
+	From  string
+	To    string
+	Label string
+}
+
+var graphIDChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func graphID(kind string, name string) string {
+	return kind + "_" + graphIDChars.ReplaceAllString(strings.TrimPrefix(name, `/dev/`), "_")
+}
+
+// Size of a block device from sysfs, eg. 1.8T, empty if unknown
+func deviceCapacity(device string) string {
+	sectors, err := strconv.ParseUint(readVal(SYSFS_CLASS_BLOCK+blockName(device)+`/size`), 10, 64)
+	if err != nil {
+		return ""
+	}
+	return BytesToHuman(sectors * 512)
+}
+
+func withCapacity(lines []string, device string) []string {
+	if capacity := deviceCapacity(device); capacity != "" {
+		lines = append(lines, capacity)
+	}
+	return lines
+}
+
+// Nodes and edges of the topology: cache devices -> cache set -> bcacheN <- backing device
+func (b *BcacheDevs) graph() (nodes []graphNode, edges []graphEdge) {
+	cdevs := append([]Bcache_cdev(nil), b.Cdevs...)
+	sort.Slice(cdevs, func(i, j int) bool { return cdevs[i].Dev < cdevs[j].Dev })
+	for _, cdev := range cdevs {
+		setID := graphID("cset", cdev.UUID)
+		nodes = append(nodes, graphNode{ID: setID, Shape: "set", Lines: []string{"cache set", cdev.UUID}})
+		for _, member := range cacheSetMembers(cdev.UUID) {
+			dev := cacheMemberDev(cdev.UUID, member)
+			id := graphID("cache", dev)
+			nodes = append(nodes, graphNode{ID: id, Shape: "cache", Lines: withCapacity([]string{dev}, dev)})
+			edges = append(edges, graphEdge{From: id, To: setID})
+		}
+	}
+	for i := range b.Bdevs {
+		bdev := &b.Bdevs[i]
+		id := graphID("bcache", bdev.ShortName)
+		lines := []string{bdev.ShortName}
+		if bdev.Label != "" {
+			lines = append(lines, "label "+bdev.Label)
+		}
+		if bdev.CUUID != NONE_ATTACHED {
+			lines = append(lines, bdev.Val(`cache_mode`)+", "+bdev.Val(`state`))
+			if dirty := bdev.Val(`dirty_data`); dirty != "" {
+				lines = append(lines, "dirty "+dirty)
+			}
+			edges = append(edges, graphEdge{From: graphID("cset", bdev.CUUID), To: id, Label: bdev.Val(`cache_mode`)})
+		} else {
+			lines = append(lines, NONE_ATTACHED)
+		}
+		nodes = append(nodes, graphNode{ID: id, Shape: "bcache", Lines: lines})
+		backingID := graphID("backing", bdev.BackingDev)
+		nodes = append(nodes, graphNode{ID: backingID, Shape: "backing", Lines: withCapacity([]string{bdev.BackingDev}, bdev.BackingDev)})
+		edges = append(edges, graphEdge{From: backingID, To: id})
+	}
+	return
+}
+
+func dotGraph(nodes []graphNode, edges []graphEdge) string {
+	shapes := map[string]string{"set": "ellipse", "cache": "cylinder", "bcache": "box", "backing": "cylinder"}
+	var out strings.Builder
+	out.WriteString("digraph bcache {\n\trankdir=LR;\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&out, "\t%s [shape=%s, label=%q];\n", n.ID, shapes[n.Shape], strings.Join(n.Lines, "\n"))
+	}
+	for _, e := range edges {
+		if e.Label != "" {
+			fmt.Fprintf(&out, "\t%s -> %s [label=%q];\n", e.From, e.To, e.Label)
+		} else {
+			fmt.Fprintf(&out, "\t%s -> %s;\n", e.From, e.To)
+		}
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+func mermaidGraph(nodes []graphNode, edges []graphEdge) string {
+	shapes := map[string][2]string{"set": {"((", "))"}, "cache": {"[(", ")]"}, "bcache": {"[", "]"}, "backing": {"[(", ")]"}}
+	var out strings.Builder
+	out.WriteString("graph LR\n")
+	for _, n := range nodes {
+		shape := shapes[n.Shape]
+		fmt.Fprintf(&out, "    %s%s\"%s\"%s\n", n.ID, shape[0], strings.ReplaceAll(strings.Join(n.Lines, "<br/>"), `"`, `#quot;`), shape[1])
+	}
+	for _, e := range edges {
+		if e.Label != "" {
+			fmt.Fprintf(&out, "    %s -->|%s| %s\n", e.From, e.Label, e.To)
+		} else {
+			fmt.Fprintf(&out, "    %s --> %s\n", e.From, e.To)
+		}
+	}
+	return out.String()
+}
+
+// Render the topology as a Graphviz (dot) or Mermaid graph. Nodes are cache sets, cache
+// devices, bcache devices and backing devices, annotated with cache mode, state, dirty data
+// and capacity.
+func (b *BcacheDevs) Graph(format string) (string, error) {
+	nodes, edges := b.graph()
+	switch format {
+	case GRAPH_DOT:
+		return dotGraph(nodes, edges), nil
+	case GRAPH_MERMAID:
+		return mermaidGraph(nodes, edges), nil
+	}
+	return "", errors.New("unknown graph format " + format + " (expecting " + GRAPH_DOT + " or " + GRAPH_MERMAID + ")")
+}
@@ -0,0 +1,210 @@
+package bcache
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const SYSFS_CLASS_BLOCK = `/sys/class/block/`
+const MOUNTINFO = `/proc/self/mountinfo`
+const PROC_SWAPS = `/proc/swaps`
+
+// Ways a block device can be in use
+const (
+	USER_HOLDER = "holder"
+	USER_MOUNT  = "mount"
+	USER_SWAP   = "swap"
+)
+
+// Something using a block device: a device stacked on top of it (dm, md), a mounted
+// filesystem or active swap. Device is the device in use, the device itself or one of its
+// partitions.
+type DeviceUser struct {
+	Kind   string `json:"kind" yaml:"kind"`
+	Device string `json:"device" yaml:"device"`
+	Name   string `json:"name" yaml:"name"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+func (u DeviceUser) String() string {
+	var s string
+	switch u.Kind {
+	case USER_MOUNT:
+		s = "mounted on " + u.Name
+	case USER_SWAP:
+		s = "active swap " + u.Name
+	default:
+		s = "held by " + u.Name
+	}
+	if u.Detail != "" {
+		s += " (" + u.Detail + ")"
+	}
+	if u.Kind != USER_SWAP || u.Name != `/dev/`+u.Device {
+		s += " via " + u.Device
+	}
+	return s
+}
+
+// Name of a block device as in /sys/class/block, from a name, /dev path or symlink
+func blockName(device string) string {
+	if !strings.HasPrefix(device, `/`) {
+		return device
+	}
+	if real, err := filepath.EvalSymlinks(device); err == nil {
+		device = real
+	}
+	return filepath.Base(device)
+}
+
+// The device and its partitions
+func withPartitions(name string) (names []string) {
+	names = append(names, name)
+	entries, _ := os.ReadDir(SYSFS_CLASS_BLOCK + name)
+	for _, j := range entries {
+		if _, err := os.Stat(SYSFS_CLASS_BLOCK + name + `/` + j.Name() + `/partition`); err == nil {
+			names = append(names, j.Name())
+		}
+	}
+	return
+}
+
+// What a holder is, eg. 'LVM vg0-data', 'dm-crypt luks-1234' or 'md'
+func holderDetail(holder string) string {
+	if strings.HasPrefix(holder, `md`) {
+		return "md"
+	}
+	dmName := readVal(SYSFS_CLASS_BLOCK + holder + `/dm/name`)
+	dmUUID := readVal(SYSFS_CLASS_BLOCK + holder + `/dm/uuid`)
+	switch {
+	case strings.HasPrefix(dmUUID, `LVM-`):
+		return "LVM " + dmName
+	case strings.HasPrefix(dmUUID, `CRYPT-`):
+		return "dm-crypt " + dmName
+	case dmName != "":
+		return "device mapper " + dmName
+	}
+	return ""
+}
+
+// Mount points from /proc/self/mountinfo, by major:minor and by the block device name of
+// the mount source. Filesystems such as btrfs report an anonymous major:minor (0:NN), they
+// are only found by their source.
+func mountsByDev() (byDevNum map[string][]DeviceUser, bySource map[string][]DeviceUser) {
+	byDevNum = make(map[string][]DeviceUser)
+	bySource = make(map[string][]DeviceUser)
+	f, err := os.Open(MOUNTINFO)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		u := DeviceUser{Kind: USER_MOUNT, Name: fields[4]}
+		var source string
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				u.Detail = fields[i+1]
+				if i+2 < len(fields) && strings.HasPrefix(fields[i+2], `/dev/`) {
+					source = blockName(fields[i+2])
+				}
+				break
+			}
+		}
+		byDevNum[fields[2]] = append(byDevNum[fields[2]], u)
+		if source != "" {
+			bySource[source] = append(bySource[source], u)
+		}
+	}
+	return
+}
+
+// Active swap devices by device name from /proc/swaps
+func swapsByName() map[string]string {
+	swaps := make(map[string]string)
+	f, err := os.Open(PROC_SWAPS)
+	if err != nil {
+		return swaps
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "Filename" || !strings.HasPrefix(fields[0], `/dev/`) {
+			continue
+		}
+		swaps[blockName(fields[0])] = fields[0]
+	}
+	return swaps
+}
+
+// Holders, mounted filesystems and swap on a block device or its partitions. device is a
+// name (bcache0, sdb) or /dev path.
+func DeviceUsers(device string) (users []DeviceUser) {
+	byDevNum, bySource := mountsByDev()
+	swaps := swapsByName()
+	for _, name := range withPartitions(blockName(device)) {
+		holders, _ := os.ReadDir(SYSFS_CLASS_BLOCK + name + `/holders`)
+		for _, j := range holders {
+			users = append(users, DeviceUser{Kind: USER_HOLDER, Device: name, Name: j.Name(), Detail: holderDetail(j.Name())})
+		}
+		mounts := bySource[name]
+		if devNum := readVal(SYSFS_CLASS_BLOCK + name + `/dev`); devNum != "" {
+			mounts = append(mounts, byDevNum[devNum]...)
+		}
+		seen := make(map[string]bool)
+		for _, u := range mounts {
+			if !seen[u.Name] {
+				seen[u.Name] = true
+				u.Device = name
+				users = append(users, u)
+			}
+		}
+		if swap, found := swaps[name]; found {
+			users = append(users, DeviceUser{Kind: USER_SWAP, Device: name, Name: swap})
+		}
+	}
+	return
+}
+
+// Error explaining what is using a device, nil if nothing is
+func CheckNotInUse(device string) error {
+	users := DeviceUsers(device)
+	if len(users) == 0 {
+		return nil
+	}
+	var uses []string
+	for _, u := range users {
+		uses = append(uses, u.String())
+	}
+	return errors.New(device + " is in use: " + strings.Join(uses, ", "))
+}
+
+// Error explaining what is using a registered device or a plain block device. For a cache
+// set (uuid or cache device) every attached backing device is checked, for a backing device
+// its bcacheN device.
+func (b *BcacheDevs) InUse(device string) error {
+	if x, cdev := b.IsCDevice(device); x {
+		var errs []string
+		for _, bdev := range b.attachedTo(cdev.UUID) {
+			if err := CheckNotInUse(bdev.ShortName); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			return errors.New("cache set " + cdev.UUID + " has backing devices in use: " + strings.Join(errs, "; "))
+		}
+		return nil
+	}
+	if x, bdev := b.IsBDevice(device); x {
+		return CheckNotInUse(bdev.ShortName)
+	}
+	return CheckNotInUse(device)
+}
@@ -0,0 +1,186 @@
+package bcache
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strings"
+)
+
+// User defined profiles are read from <name>.yaml files in this dir, eg.
+//
+//	description: nightly backup target
+//	settings:
+//	  cache_mode: writearound
+//	  sequential_cutoff: 1M
+const PROFILE_DIR = `/etc/bcachectl/profiles/`
+
+// Config file key referencing a profile, settings of the section override the profile
+const PROFILE_KEY = `profile`
+
+// A named set of tunables
+type Profile struct {
+	Name        string      `yaml:"-"`
+	Description string      `yaml:"description"`
+	Settings    DriveConfig `yaml:"settings"`
+	BuiltIn     bool        `yaml:"-"`
+}
+
+var PROFILES = []Profile{
+	{
+		Name:        `ceph-hdd`,
+		Description: `HDD backed Ceph OSDs, small writes are absorbed by the cache and never bypass it on congestion`,
+		Settings: DriveConfig{
+			`cache_mode`:                   `writeback`,
+			`sequential_cutoff`:            `4M`,
+			`writeback_percent`:            `10`,
+			`writeback_delay`:              `30`,
+			`readahead`:                    `0`,
+			`congested_read_threshold_us`:  `0`,
+			`congested_write_threshold_us`: `0`,
+		},
+	},
+	{
+		Name:        `oltp`,
+		Description: `database volumes with small random IO, more dirty data is kept to absorb write bursts`,
+		Settings: DriveConfig{
+			`cache_mode`:                   `writeback`,
+			`sequential_cutoff`:            `1M`,
+			`writeback_percent`:            `20`,
+			`writeback_delay`:              `10`,
+			`readahead`:                    `0`,
+			`congested_read_threshold_us`:  `2000`,
+			`congested_write_threshold_us`: `20000`,
+		},
+	},
+	{
+		Name:        `vm-images`,
+		Description: `VM image stores, mixed IO with a larger sequential cutoff for image copies`,
+		Settings: DriveConfig{
+			`cache_mode`:                   `writeback`,
+			`sequential_cutoff`:            `8M`,
+			`writeback_percent`:            `10`,
+			`writeback_delay`:              `30`,
+			`readahead`:                    `0`,
+			`congested_read_threshold_us`:  `2000`,
+			`congested_write_threshold_us`: `20000`,
+		},
+	},
+	{
+		Name:        `sequential-archive`,
+		Description: `backup and archive targets, sequential streams bypass the cache and writes never go dirty`,
+		Settings: DriveConfig{
+			`cache_mode`:                   `writearound`,
+			`sequential_cutoff`:            `512k`,
+			`writeback_percent`:            `10`,
+			`writeback_delay`:              `30`,
+			`readahead`:                    `1M`,
+			`congested_read_threshold_us`:  `2000`,
+			`congested_write_threshold_us`: `20000`,
+		},
+	},
+	{
+		Name:        `flush-fast`,
+		Description: `stop caching new writes and write back all dirty data as fast as possible, eg. before maintenance`,
+		Settings: DriveConfig{
+			`cache_mode`:                   `writethrough`,
+			`sequential_cutoff`:            `0`,
+			`writeback_percent`:            `0`,
+			`writeback_delay`:              `0`,
+			`writeback_rate_minimum`:       `8192`,
+			`readahead`:                    `0`,
+			`congested_read_threshold_us`:  `2000`,
+			`congested_write_threshold_us`: `20000`,
+		},
+	},
+}
+
+// Find a profile by name, user defined profiles in PROFILE_DIR take precedence over
+// built-in ones
+func LookupProfile(name string) (p Profile, err error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return p, errors.New("invalid profile name: " + name)
+	}
+	f, err := os.ReadFile(PROFILE_DIR + name + `.yaml`)
+	if err == nil {
+		if err = yaml.UnmarshalStrict(f, &p); err != nil {
+			return p, errors.New("could not read profile " + name + ": " + err.Error())
+		}
+		p.Name = name
+		for tunable := range p.Settings {
+			if _, found := LookupTunable(tunable); !found {
+				return p, errors.New("tunable not in allowed list: " + tunable + " (profile " + name + ")")
+			}
+		}
+		return p, nil
+	}
+	for _, p = range PROFILES {
+		if p.Name == name {
+			p.BuiltIn = true
+			return p, nil
+		}
+	}
+	return Profile{}, errors.New("unknown profile: " + name)
+}
+
+// Built-in and user defined profiles, sorted by name
+func ListProfiles() (profiles []Profile) {
+	names := make(map[string]bool)
+	for _, p := range PROFILES {
+		names[p.Name] = true
+	}
+	entries, _ := os.ReadDir(PROFILE_DIR)
+	for _, j := range entries {
+		if strings.HasSuffix(j.Name(), `.yaml`) {
+			names[strings.TrimSuffix(j.Name(), `.yaml`)] = true
+		}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		p, err := LookupProfile(name)
+		if err != nil {
+			p = Profile{Name: name, Description: err.Error()}
+		}
+		profiles = append(profiles, p)
+	}
+	return
+}
+
+// Settings of the profile that apply to the given scopes
+func (p Profile) ScopeSettings(scopes ...string) DriveConfig {
+	settings := make(DriveConfig)
+	for tunable, val := range p.Settings {
+		if t, found := LookupTunable(tunable); found && contains(scopes, t.Scope) {
+			settings[tunable] = val
+		}
+	}
+	return settings
+}
+
+// Apply the backing device tunables of a profile. Cache set and cache member tunables are
+// shared by every device of the cache set and are only applied to the cache set itself.
+func (b *Bcache_bdev) ApplyProfile(p Profile) error {
+	settings := p.ScopeSettings(SCOPE_BACKING)
+	for _, tunable := range orderedTunables(settings) {
+		if err := b.Tune(tunable + `:` + settings[tunable]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the cache set and cache member tunables of a profile to a cache set
+func (c *Bcache_cdev) ApplyProfile(p Profile) error {
+	settings := p.ScopeSettings(SCOPE_CACHE_SET, SCOPE_CACHE)
+	for _, tunable := range orderedTunables(settings) {
+		if err := c.Tune(tunable + `:` + settings[tunable]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
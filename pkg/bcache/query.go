@@ -0,0 +1,185 @@
+package bcache
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of cache set attributes in columns, filters and sorting, eg. set.cache_available_percent
+const SET_COLUMN_PREFIX = `set.`
+
+// Value of a column of a backing device. A column is one of the device fields (BcacheDev,
+// ShortName, BackingDev, CacheDev, BcacheDevUUID, CacheSetUUID, Label), a tunable of any
+// scope, a backing device attribute or stat (eg. dirty_data, stats_hour/cache_hit_ratio)
+// or a cache set attribute prefixed with 'set.'. Sizes are formatted like BytesToHuman.
+func (b *Bcache_bdev) Column(name string) string {
+	switch name {
+	case "BcacheDev":
+		return b.BcacheDev
+	case "ShortName":
+		return b.ShortName
+	case "BackingDev":
+		return b.BackingDev
+	case "CacheDev":
+		return b.CacheDev
+	case "BcacheDevUUID":
+		return b.BUUID
+	case "CacheSetUUID":
+		return b.CUUID
+	case "Label":
+		return b.Label
+	}
+	var val string
+	if strings.HasPrefix(name, SET_COLUMN_PREFIX) {
+		if b.CUUID != NONE_ATTACHED {
+			val = ReadSysfs(SYSFS_BCACHE_ROOT + b.CUUID + `/` + strings.TrimPrefix(name, SET_COLUMN_PREFIX))
+		}
+	} else if t, found := LookupTunable(name); found && t.Scope != SCOPE_BACKING {
+		if b.CUUID != NONE_ATTACHED {
+			path := SYSFS_BCACHE_ROOT + b.CUUID + `/` + t.Path
+			if t.Scope == SCOPE_CACHE {
+				path = SYSFS_BCACHE_ROOT + b.CUUID + `/cache0/` + t.Path
+			}
+			val = ReadSysfs(path)
+		}
+	} else if found {
+		val = b.Val(t.Path)
+	} else if v, found := b.Parameters[name]; found && v != nil {
+		val, _ = v.(string)
+	} else {
+		val = b.Val(name)
+	}
+	return normalizeSize(val)
+}
+
+// Sizes from sysfs come as eg. 1.2G, 512k or 4.0M, give them all one decimal
+func normalizeSize(val string) string {
+	if humanSize.MatchString(val) {
+		n, _ := strconv.ParseUint(HumanToBytes(val), 10, 64)
+		return BytesToHuman(n)
+	}
+	return val
+}
+
+// Numeric value of a column value or filter operand: plain numbers, sizes (1.2G) and
+// percentages (45%)
+func numericValue(val string) (float64, bool) {
+	val = strings.TrimSuffix(strings.TrimSpace(val), `%`)
+	if strings.HasSuffix(val, `K`) {
+		val = strings.TrimSuffix(val, `K`) + `k`
+	}
+	if humanSize.MatchString(val) {
+		n, err := strconv.ParseFloat(HumanToBytes(val), 64)
+		return n, err == nil
+	}
+	n, err := strconv.ParseFloat(val, 64)
+	return n, err == nil
+}
+
+// A condition on a column, eg. state=dirty or dirty_data>1G
+type Filter struct {
+	Column string
+	Op     string
+	Value  string
+}
+
+// Longer operators first, so >= is not read as >
+var filterOps = []string{`!=`, `>=`, `<=`, `=`, `>`, `<`}
+
+// Parse comma separated conditions, eg. 'state=dirty,cache_mode=writeback,dirty_data>1G'
+func ParseFilters(s string) (filters []Filter, err error) {
+	if s == "" {
+		return
+	}
+	for _, cond := range strings.Split(s, `,`) {
+		found := false
+		for _, op := range filterOps {
+			if i := strings.Index(cond, op); i > 0 {
+				filters = append(filters, Filter{Column: strings.TrimSpace(cond[:i]), Op: op, Value: strings.TrimSpace(cond[i+len(op):])})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("bad filter '" + cond + "', expecting <column><op><value> with op one of " + strings.Join(filterOps, " "))
+		}
+	}
+	return
+}
+
+// Compare two column values numerically when both are numbers or sizes, as strings otherwise
+func compareValues(a string, b string) int {
+	na, okA := numericValue(a)
+	nb, okB := numericValue(b)
+	if okA && okB {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func (f Filter) Matches(b *Bcache_bdev) bool {
+	c := compareValues(b.Column(f.Column), f.Value)
+	switch f.Op {
+	case `=`:
+		return c == 0
+	case `!=`:
+		return c != 0
+	case `>`:
+		return c > 0
+	case `<`:
+		return c < 0
+	case `>=`:
+		return c >= 0
+	case `<=`:
+		return c <= 0
+	}
+	return false
+}
+
+// Keep the backing devices matching every filter
+func (b *BcacheDevs) FilterBdevs(filters []Filter) {
+	var kept []Bcache_bdev
+	for i := range b.Bdevs {
+		matches := true
+		for _, f := range filters {
+			if !f.Matches(&b.Bdevs[i]) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			kept = append(kept, b.Bdevs[i])
+		}
+	}
+	b.Bdevs = kept
+}
+
+// Sort the backing devices by a column, numerically where possible. Without a column they
+// are sorted by name.
+func (b *BcacheDevs) SortBdevs(column string, reverse bool) {
+	if column == "" {
+		column = "ShortName"
+	}
+	vals := make(map[string]string)
+	for i := range b.Bdevs {
+		vals[b.Bdevs[i].ShortName] = b.Bdevs[i].Column(column)
+	}
+	sort.SliceStable(b.Bdevs, func(i, j int) bool {
+		c := compareValues(vals[b.Bdevs[i].ShortName], vals[b.Bdevs[j].ShortName])
+		if c == 0 && column != "ShortName" {
+			c = strings.Compare(b.Bdevs[i].ShortName, b.Bdevs[j].ShortName)
+		}
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+}
@@ -0,0 +1,374 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress of cache replacements is saved here after every step, so an interrupted
+// replacement can be resumed or rolled back
+const REPLACE_DIR = `/var/lib/bcachectl/replace/`
+
+// A backing device moved from the old cache set to the new one
+type ReplaceBacking struct {
+	BUUID    string      `yaml:"buuid"`
+	Device   string      `yaml:"device"`
+	Tunables DriveConfig `yaml:"tunables"`
+	Detached bool        `yaml:"detached"`
+	Attached bool        `yaml:"attached"`
+	// tunables applied after attaching to the new cache set
+	Tuned bool `yaml:"tuned"`
+}
+
+// Checkpoint of a cache device replacement
+type CacheReplacement struct {
+	OldUUID       string           `yaml:"old_uuid"`
+	OldDev        string           `yaml:"old_device"`
+	NewDev        string           `yaml:"new_device"`
+	NewUUID       string           `yaml:"new_uuid"`
+	Wipe          bool             `yaml:"wipe"`
+	Started       time.Time        `yaml:"started"`
+	CacheSet      DriveConfig      `yaml:"cache_set"`
+	OldStopped    bool             `yaml:"old_stopped"`
+	CacheSetTuned bool             `yaml:"cache_set_tuned"`
+	Backing       []ReplaceBacking `yaml:"backing"`
+}
+
+func replacePath(oldUUID string) string {
+	return REPLACE_DIR + oldUUID + `.yaml`
+}
+
+func (r *CacheReplacement) save() error {
+	if DryRun() {
+		return nil
+	}
+	if err := os.MkdirAll(REPLACE_DIR, 0750); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(replacePath(r.OldUUID), out, 0640)
+}
+
+func (r *CacheReplacement) remove() error {
+	if DryRun() {
+		return nil
+	}
+	if err := os.Remove(replacePath(r.OldUUID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Find the checkpoint of an unfinished replacement of old (cache set uuid or device)
+func LoadReplacement(old string) (*CacheReplacement, error) {
+	entries, err := os.ReadDir(REPLACE_DIR)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		f, err := os.ReadFile(REPLACE_DIR + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		r := new(CacheReplacement)
+		if err = yaml.Unmarshal(f, r); err != nil {
+			return nil, errors.New("could not read replacement checkpoint " + entry.Name() + ": " + err.Error())
+		}
+		if r.OldUUID == old || r.OldDev == old {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// Start replacing the cache device of cache set old (uuid or cache device) with newDev,
+// or resume an unfinished replacement of it
+func (b *BcacheDevs) PlanReplaceCache(old string, newDev string, wipe bool) (r *CacheReplacement, resumed bool, err error) {
+	if r, err = LoadReplacement(old); err != nil || r != nil {
+		if r != nil && r.NewDev != newDev {
+			return nil, false, errors.New("an unfinished replacement of " + old + " uses " + r.NewDev + ", resume it with that device or roll it back")
+		}
+		return r, r != nil, err
+	}
+	x, cdev := b.IsCDevice(old)
+	if !x {
+		return nil, false, errors.New(old + " is not a registered cache set or cache device")
+	}
+	if x, _ := b.IsCDevice(newDev); x {
+		return nil, false, errors.New(newDev + " is already a registered cache device")
+	}
+	if len(cacheSetMembers(cdev.UUID)) > 1 {
+		return nil, false, errors.New("cache set " + cdev.UUID + " has more than one cache device, which is not supported")
+	}
+	current := b.GetTunables()
+	r = &CacheReplacement{
+		OldUUID:  cdev.UUID,
+		OldDev:   cdev.Dev,
+		NewDev:   newDev,
+		Wipe:     wipe,
+		Started:  time.Now(),
+		CacheSet: current.CacheSets[cdev.UUID],
+	}
+	for _, bdev := range b.Bdevs {
+		if bdev.CUUID == cdev.UUID {
+			r.Backing = append(r.Backing, ReplaceBacking{
+				BUUID:    bdev.BUUID,
+				Device:   bdev.ShortName,
+				Tunables: current.Devices[bdev.BUUID],
+			})
+		}
+	}
+	return r, false, nil
+}
+
+// Steps of the replacement that are still to be done
+func (r *CacheReplacement) Plan() (steps []string) {
+	for _, bd := range r.Backing {
+		if !bd.Detached {
+			steps = append(steps, "flush and detach "+bd.Device+" from cache set "+r.OldUUID)
+		}
+	}
+	if !r.OldStopped {
+		steps = append(steps, "unregister cache set "+r.OldUUID+" ("+r.OldDev+")")
+	}
+	if r.NewUUID == "" {
+		steps = append(steps, "format and register "+r.NewDev+" as a cache device")
+	}
+	if !r.CacheSetTuned {
+		steps = append(steps, "apply the cache set tunables of "+r.OldUUID+" to the new cache set")
+	}
+	for _, bd := range r.Backing {
+		if !bd.Attached {
+			steps = append(steps, "attach "+bd.Device+" to the new cache set and apply its tunables (cache_mode "+bd.Tunables[`cache_mode`]+")")
+		} else if !bd.Tuned {
+			steps = append(steps, "apply the tunables of "+bd.Device+" (cache_mode "+bd.Tunables[`cache_mode`]+")")
+		}
+	}
+	return
+}
+
+func applyTunables(tune func(string) error, settings DriveConfig) error {
+	for _, tunable := range orderedTunables(settings) {
+		if err := tune(tunable + `:` + settings[tunable]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait for a stopped cache set to disappear from sysfs
+func waitCacheSetGone(uuid string) error {
+	for i := 0; i < 30 && !DryRun(); i++ {
+		if _, err := os.Stat(SYSFS_BCACHE_ROOT + uuid); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	if DryRun() {
+		return nil
+	}
+	return errors.New("cache set " + uuid + " was stopped but is still in sysfs")
+}
+
+// Run the remaining steps, saving a checkpoint after each. opts is used to flush the
+// backing devices before they are detached, log is told about every completed step. When a
+// step fails, the devices that were detached are attached to the old cache set again, unless
+// ctx was cancelled or devices were already attached to the new cache set. The checkpoint is
+// kept then, to resume or roll back later.
+func (r *CacheReplacement) Run(ctx context.Context, opts FlushOptions, log func(string)) error {
+	if err := r.save(); err != nil {
+		return errors.New("could not save replacement checkpoint: " + err.Error())
+	}
+	if err := r.run(ctx, opts, log); err != nil {
+		resume := "progress is saved in " + replacePath(r.OldUUID) + ", run the same command again to resume or use --rollback"
+		if ctx.Err() != nil {
+			if saveErr := r.save(); saveErr != nil {
+				return errors.New(err.Error() + "; could not save replacement checkpoint: " + saveErr.Error())
+			}
+			return errors.New(err.Error() + "; interrupted, " + resume)
+		}
+		if len(r.attached()) > 0 {
+			return errors.New(err.Error() + "; " + strings.Join(r.attached(), ", ") + " already attached to the new cache set " + r.NewUUID + ", " + resume)
+		}
+		if rbErr := r.Rollback(log); rbErr != nil {
+			return errors.New(err.Error() + "; rollback failed: " + rbErr.Error() + " (progress is saved in " + replacePath(r.OldUUID) + ")")
+		}
+		return errors.New(err.Error() + "; detached devices were attached to cache set " + r.OldUUID + " again")
+	}
+	return r.remove()
+}
+
+func (r *CacheReplacement) run(ctx context.Context, opts FlushOptions, log func(string)) error {
+	for i := range r.Backing {
+		bd := &r.Backing[i]
+		if bd.Detached {
+			continue
+		}
+		all, err := AllDevs()
+		if err != nil {
+			return err
+		}
+		if err = all.SafeDetach(ctx, r.OldUUID, bd.Device, true, false, opts); err != nil {
+			return err
+		}
+		bd.Detached = true
+		if err = r.save(); err != nil {
+			return err
+		}
+		log("detached " + bd.Device + " from cache set " + r.OldUUID)
+	}
+	if !r.OldStopped {
+		all, err := AllDevs()
+		if err != nil {
+			return err
+		}
+		if err = all.UnregisterCache(r.OldUUID); err != nil {
+			return err
+		}
+		if err = waitCacheSetGone(r.OldUUID); err != nil {
+			return err
+		}
+		r.OldStopped = true
+		if err = r.save(); err != nil {
+			return err
+		}
+		log("unregistered cache set " + r.OldUUID)
+	}
+	if r.NewUUID == "" {
+		all, err := AllDevs()
+		if err != nil {
+			return err
+		}
+		if err = all.Format("", r.NewDev, r.Wipe, false); err != nil {
+			return err
+		}
+		if DryRun() {
+			r.NewUUID = "<new cset uuid>"
+			return nil
+		}
+		if all, err = AllDevs(); err != nil {
+			return err
+		}
+		x, cdev := all.IsCDevice(r.NewDev)
+		if !x {
+			return errors.New(r.NewDev + " was formatted but is not registered as a cache device")
+		}
+		r.NewUUID = cdev.UUID
+		if err = r.save(); err != nil {
+			return err
+		}
+		log("formatted " + r.NewDev + " as cache set " + r.NewUUID)
+	}
+	if !r.CacheSetTuned {
+		cdev := Bcache_cdev{Dev: r.NewDev, UUID: r.NewUUID}
+		if err := applyTunables(cdev.Tune, r.CacheSet); err != nil {
+			return errors.New("could not apply cache set tunables: " + err.Error())
+		}
+		r.CacheSetTuned = true
+		if err := r.save(); err != nil {
+			return err
+		}
+		log("applied cache set tunables to " + r.NewUUID)
+	}
+	for i := range r.Backing {
+		bd := &r.Backing[i]
+		if bd.Attached && bd.Tuned {
+			continue
+		}
+		all, err := AllDevs()
+		if err != nil {
+			return err
+		}
+		if !bd.Attached {
+			if err = all.Attach(r.NewUUID, bd.Device); err != nil {
+				return err
+			}
+			bd.Attached = true
+			if err = r.save(); err != nil {
+				return err
+			}
+			log("attached " + bd.Device + " to cache set " + r.NewUUID)
+		}
+		bdev, err := all.LookupBDevice(bd.Device)
+		if err != nil {
+			return err
+		}
+		if err = applyTunables(bdev.Tune, bd.Tunables); err != nil {
+			return errors.New("attached " + bd.Device + " but could not apply its tunables: " + err.Error())
+		}
+		bd.Tuned = true
+		if err = r.save(); err != nil {
+			return err
+		}
+		log("applied the tunables of " + bd.Device)
+	}
+	return nil
+}
+
+// Attach the backing devices that were detached but not yet moved to the new cache set
+// to the old cache set again, registering the old cache device if it was unregistered. The
+// checkpoint is kept while devices are attached to the new cache set.
+func (r *CacheReplacement) Rollback(log func(string)) error {
+	if r.OldStopped {
+		if err := Register(r.OldDev); err != nil {
+			return errors.New("could not register old cache device " + r.OldDev + ": " + err.Error())
+		}
+		r.OldStopped = false
+		if err := r.save(); err != nil {
+			return err
+		}
+		log("registered old cache device " + r.OldDev)
+	}
+	var failed []string
+	for i := range r.Backing {
+		bd := &r.Backing[i]
+		if !bd.Detached || bd.Attached {
+			continue
+		}
+		all, err := AllDevs()
+		if err != nil {
+			return err
+		}
+		if err = all.Attach(r.OldUUID, bd.Device); err != nil {
+			failed = append(failed, bd.Device+": "+err.Error())
+			continue
+		}
+		if x, bdev := all.IsBDevice(bd.Device); x {
+			if err = applyTunables(bdev.Tune, bd.Tunables); err != nil {
+				failed = append(failed, bd.Device+": "+err.Error())
+			}
+		}
+		bd.Detached = false
+		if err = r.save(); err != nil {
+			return err
+		}
+		log("attached " + bd.Device + " to cache set " + r.OldUUID + " again")
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	// devices on the new cache set can only be moved by resuming the replacement
+	if len(r.attached()) > 0 {
+		return nil
+	}
+	return r.remove()
+}
+
+// Backing devices already attached to the new cache set
+func (r *CacheReplacement) attached() (devices []string) {
+	for _, bd := range r.Backing {
+		if bd.Attached {
+			devices = append(devices, bd.Device)
+		}
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package bcache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of config section selectors, from the broadest to the most specific. Settings
+// of more specific sections override those of broader ones.
+const (
+	SELECT_ALL    = "all"
+	SELECT_MODE   = "mode"
+	SELECT_CSET   = "cset"
+	SELECT_NAME   = "name"
+	SELECT_LABEL  = "label"
+	SELECT_BY_ID  = "by-id"
+	SELECT_DEVICE = "device"
+)
+
+var selectorOrder = []string{SELECT_ALL, SELECT_MODE, SELECT_CSET, SELECT_NAME, SELECT_LABEL, SELECT_BY_ID, SELECT_DEVICE}
+
+const BY_ID_DIR = `/dev/disk/by-id/`
+
+// A config section key and the devices it applies to. Section keys are 'all', a backing
+// device uuid, or one of:
+//
+//	mode:<cache mode>    devices currently in this cache mode
+//	cset:<uuid>          devices attached to this cache set
+//	name:<glob>          devices whose bcache or backing device name matches, eg. name:sd[b-d]
+//	label:<glob>         devices whose label matches
+//	by-id:<name>         the device behind /dev/disk/by-id/<name> (a full path also works)
+type Selector struct {
+	Section string
+	Kind    string
+	Pattern string
+}
+
+func ParseSelector(section string) (s Selector, err error) {
+	s.Section = section
+	if section == SELECT_ALL {
+		s.Kind = SELECT_ALL
+		return
+	}
+	if strings.HasPrefix(section, BY_ID_DIR) {
+		s.Kind = SELECT_BY_ID
+		s.Pattern = section
+		return
+	}
+	section_a := strings.SplitN(section, ":", 2)
+	if len(section_a) == 1 {
+		s.Kind = SELECT_DEVICE
+		s.Pattern = section
+		return
+	}
+	kind, pattern := section_a[0], section_a[1]
+	switch kind {
+	case SELECT_MODE, SELECT_CSET, SELECT_NAME, SELECT_LABEL, SELECT_BY_ID:
+	default:
+		return s, errors.New("unknown selector '" + kind + "' in config section " + section)
+	}
+	if pattern == "" {
+		return s, errors.New("empty selector in config section " + section)
+	}
+	if kind == SELECT_NAME || kind == SELECT_LABEL {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return s, errors.New("bad pattern in config section " + section + ": " + err.Error())
+		}
+	}
+	s.Kind = kind
+	s.Pattern = pattern
+	return
+}
+
+func (s Selector) rank() int {
+	for i, kind := range selectorOrder {
+		if kind == s.Kind {
+			return i
+		}
+	}
+	return len(selectorOrder)
+}
+
+func sameDevice(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	ra, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		return false
+	}
+	rb, err := filepath.EvalSymlinks(b)
+	return err == nil && ra == rb
+}
+
+func (s Selector) Matches(bdev *Bcache_bdev) bool {
+	switch s.Kind {
+	case SELECT_ALL:
+		return true
+	case SELECT_MODE:
+		return bdev.Val(`cache_mode`) == s.Pattern
+	case SELECT_CSET:
+		return bdev.CUUID == s.Pattern
+	case SELECT_NAME:
+		for _, name := range []string{bdev.ShortName, filepath.Base(bdev.BackingDev)} {
+			if matched, _ := filepath.Match(s.Pattern, name); matched {
+				return true
+			}
+		}
+	case SELECT_LABEL:
+		matched, _ := filepath.Match(s.Pattern, bdev.Label)
+		return bdev.Label != "" && matched
+	case SELECT_BY_ID:
+		link := s.Pattern
+		if !strings.HasPrefix(link, `/`) {
+			link = BY_ID_DIR + link
+		}
+		if _, err := os.Lstat(link); err != nil {
+			return false
+		}
+		return sameDevice(link, bdev.BackingDev) || sameDevice(link, bdev.BcacheDev)
+	case SELECT_DEVICE:
+		return bdev.BUUID == s.Pattern
+	}
+	return false
+}
+
+// Selectors of all device sections, ordered by precedence (lowest first), then by name
+func (c *TuneConfig) Selectors() (selectors []Selector, err error) {
+	for section := range c.Devices {
+		s, err := ParseSelector(section)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, s)
+	}
+	sort.Slice(selectors, func(i, j int) bool {
+		if selectors[i].rank() != selectors[j].rank() {
+			return selectors[i].rank() < selectors[j].rank()
+		}
+		return selectors[i].Section < selectors[j].Section
+	})
+	return
+}
+
+// Effective value of a tunable and the config section it came from. Overrides lists the
+// sections with a lower precedence that also set the tunable.
+type EffectiveSetting struct {
+	Tunable   string
+	Value     string
+	Section   string
+	Overrides []string
+}
+
+// Tunables of a section in the order they should be applied (cache_mode and
+// writeback_running last)
+func orderedTunables(cfg DriveConfig) (tunables []string) {
+	for tunable := range cfg {
+		tunables = append(tunables, tunable)
+	}
+	sort.SliceStable(tunables, func(i, j int) bool {
+		if restoreOrder(tunables[i]) != restoreOrder(tunables[j]) {
+			return restoreOrder(tunables[i]) < restoreOrder(tunables[j])
+		}
+		return tunables[i] < tunables[j]
+	})
+	return
+}
+
+// Merge the given sections of a config, later sections override earlier ones. A section
+// referencing a profile gets the profile settings of the given scopes first, overridden
+// by its own settings. The result is in the order settings should be applied.
+func mergeSections(sections map[string]DriveConfig, names []string, scopes ...string) ([]EffectiveSetting, error) {
+	merged := make(DriveConfig)
+	from := make(map[string]*EffectiveSetting)
+	set := func(tunable string, val string, section string) {
+		if e, found := from[tunable]; found {
+			e.Overrides = append(e.Overrides, e.Section)
+			e.Value = val
+			e.Section = section
+		} else {
+			from[tunable] = &EffectiveSetting{Tunable: tunable, Value: val, Section: section}
+		}
+		merged[tunable] = val
+	}
+	for _, name := range names {
+		if profile, found := sections[name][PROFILE_KEY]; found {
+			p, err := LookupProfile(profile)
+			if err != nil {
+				return nil, errors.New(err.Error() + " (config section " + name + ")")
+			}
+			for tunable, val := range p.ScopeSettings(scopes...) {
+				set(tunable, val, name+" (profile "+profile+")")
+			}
+		}
+		for tunable, val := range sections[name] {
+			if tunable != PROFILE_KEY {
+				set(tunable, val, name)
+			}
+		}
+	}
+	var settings []EffectiveSetting
+	for _, tunable := range orderedTunables(merged) {
+		settings = append(settings, *from[tunable])
+	}
+	return settings, nil
+}
+
+// Effective settings of a backing device: 'all', then every matching selector section,
+// then the section of its backing device uuid. Only the backing device tunables of profiles
+// are used, cache set tunables of a profile apply through the cache_sets sections.
+func (c *TuneConfig) Resolve(bdev *Bcache_bdev) ([]EffectiveSetting, error) {
+	selectors, err := c.Selectors()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range selectors {
+		if s.Matches(bdev) {
+			names = append(names, s.Section)
+		}
+	}
+	return mergeSections(c.Devices, names, SCOPE_BACKING)
+}
+
+// Effective settings of a cache set: 'all' under cache_sets, then its own section
+func (c *TuneConfig) ResolveCacheSet(uuid string) ([]EffectiveSetting, error) {
+	return mergeSections(c.CacheSets, []string{SELECT_ALL, uuid}, SCOPE_CACHE_SET, SCOPE_CACHE)
+}
@@ -0,0 +1,250 @@
+package bcache
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const MODULES_LOAD_FILE = `/etc/modules-load.d/bcache.conf`
+const SYSTEMD_UNIT = `bcachectl.service`
+const SYSTEMD_UNIT_FILE = `/etc/systemd/system/` + SYSTEMD_UNIT
+const MAN_PAGE_FILE = `/usr/share/man/man8/bcachectl.man.8.gz`
+
+// A piece of host integration managed by 'bcachectl setup' and 'bcachectl teardown'
+type SetupItem struct {
+	Name string
+	// Whether the item is in place, and what is wrong when it isn't
+	Check   func() (bool, string)
+	Install func() error
+	// nil when teardown leaves the item in place
+	Remove func() error
+}
+
+// systemd unit applying the config file at boot
+func SystemdUnit(bcachectl string, configFile string) string {
+	return "[Unit]\n" +
+		"Description=Tune bcache devices\n" +
+		"After=systemd-modules-load.service\n" +
+		"\n" +
+		"[Service]\n" +
+		"Type=oneshot\n" +
+		"ExecStart=" + bcachectl + " tune from-file " + configFile + "\n" +
+		"\n" +
+		"[Install]\n" +
+		"WantedBy=multi-user.target\n"
+}
+
+// Write a file outside sysfs through the executor, creating its dir
+func writeHostFile(path string, content string, mode os.FileMode) error {
+	return Exec.Change(Action{Path: path, Value: "write " + filepath.Base(path)}, func() error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(content), mode)
+	})
+}
+
+func removeHostFile(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return Exec.Change(Action{Path: path, Value: "remove " + filepath.Base(path)}, func() error {
+		return os.Remove(path)
+	})
+}
+
+// Check that a file has exactly the given content
+func fileMatches(path string, content string) (bool, string) {
+	f, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, path + " is missing"
+	} else if err != nil {
+		return false, err.Error()
+	}
+	if string(f) != content {
+		return false, path + " is out of date"
+	}
+	return true, ""
+}
+
+func runHost(name string, args ...string) error {
+	if out, err := Exec.RunArgs(name, args...); err != nil {
+		return errors.New(name + " " + strings.Join(args, " ") + ": " + strings.TrimSpace(out) + " " + err.Error())
+	}
+	return nil
+}
+
+// Config file seeded from the current tunables of all devices
+func seedConfig() (string, error) {
+	header := "## bcachectl tuning file, seeded by 'bcachectl setup' from the tunables at " +
+		time.Now().Format("2006-01-02 15:04:05 MST") + "\n" +
+		"## to apply these tunables, 'bcachectl tune from-file /path/to/this/file'\n"
+	// nothing can be registered yet
+	if !BcacheModuleLoaded() {
+		return header, nil
+	}
+	all, err := AllDevs()
+	if err != nil {
+		return "", err
+	}
+	cfg := all.GetTunables()
+	if len(cfg.Devices) == 0 && len(cfg.CacheSets) == 0 {
+		return header, nil
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return header + string(out), nil
+}
+
+// Everything setup installs, in order. Teardown removes them in reverse order, the
+// config file is only removed when purge is set and the module is never unloaded. The
+// man page is installed from manPage (a gzipped man page, eg. the one shipped in the
+// snap), it is left out when manPage is empty.
+func HostSetup(bcachectl string, configFile string, manPage string, purge bool) []SetupItem {
+	items := []SetupItem{
+		{
+			Name: "bcache kernel module loaded",
+			Check: func() (bool, string) {
+				if BcacheModuleLoaded() {
+					return true, ""
+				}
+				return false, SYSFS_BCACHE_ROOT + " does not exist"
+			},
+			Install: func() error {
+				return runHost(`modprobe`, `bcache`)
+			},
+		},
+		{
+			Name: "bcache module loaded at boot",
+			Check: func() (bool, string) {
+				f, err := os.ReadFile(MODULES_LOAD_FILE)
+				if err != nil {
+					return false, MODULES_LOAD_FILE + " is missing"
+				}
+				for _, line := range strings.Split(string(f), "\n") {
+					if strings.TrimSpace(line) == "bcache" {
+						return true, ""
+					}
+				}
+				return false, MODULES_LOAD_FILE + " does not load bcache"
+			},
+			Install: func() error {
+				return writeHostFile(MODULES_LOAD_FILE, "bcache\n", 0644)
+			},
+			Remove: func() error {
+				return removeHostFile(MODULES_LOAD_FILE)
+			},
+		},
+		{
+			Name: "config file",
+			Check: func() (bool, string) {
+				if _, err := os.Stat(configFile); err != nil {
+					return false, configFile + " is missing"
+				}
+				return true, ""
+			},
+			Install: func() error {
+				content, err := seedConfig()
+				if err != nil {
+					return err
+				}
+				return writeHostFile(configFile, content, 0644)
+			},
+		},
+		{
+			Name: "systemd unit " + SYSTEMD_UNIT,
+			Check: func() (bool, string) {
+				if ok, detail := fileMatches(SYSTEMD_UNIT_FILE, SystemdUnit(bcachectl, configFile)); !ok {
+					return ok, detail
+				}
+				if err := exec.Command(`systemctl`, `is-enabled`, `--quiet`, SYSTEMD_UNIT).Run(); err != nil {
+					return false, SYSTEMD_UNIT + " is not enabled"
+				}
+				return true, ""
+			},
+			Install: func() error {
+				if err := writeHostFile(SYSTEMD_UNIT_FILE, SystemdUnit(bcachectl, configFile), 0644); err != nil {
+					return err
+				}
+				if err := runHost(`systemctl`, `daemon-reload`); err != nil {
+					return err
+				}
+				return runHost(`systemctl`, `enable`, SYSTEMD_UNIT)
+			},
+			Remove: func() error {
+				if _, err := os.Stat(SYSTEMD_UNIT_FILE); os.IsNotExist(err) {
+					return nil
+				}
+				if err := runHost(`systemctl`, `disable`, SYSTEMD_UNIT); err != nil {
+					return err
+				}
+				if err := removeHostFile(SYSTEMD_UNIT_FILE); err != nil {
+					return err
+				}
+				return runHost(`systemctl`, `daemon-reload`)
+			},
+		},
+		{
+			Name: "udev rule",
+			Check: func() (bool, string) {
+				return fileMatches(UDEV_RULES_FILE, UdevRule(bcachectl, configFile))
+			},
+			Install: func() error {
+				return InstallUdevRule(UDEV_RULES_FILE, bcachectl, configFile)
+			},
+			Remove: func() error {
+				if _, err := os.Stat(UDEV_RULES_FILE); os.IsNotExist(err) {
+					return nil
+				}
+				if err := removeHostFile(UDEV_RULES_FILE); err != nil {
+					return err
+				}
+				return runHost(`udevadm`, `control`, `--reload`)
+			},
+		},
+	}
+	if purge {
+		items[2].Remove = func() error {
+			return removeHostFile(configFile)
+		}
+	}
+	if manPage != "" {
+		items = append(items, SetupItem{
+			Name: "man page",
+			Check: func() (bool, string) {
+				content, err := os.ReadFile(manPage)
+				if err != nil {
+					return false, err.Error()
+				}
+				return fileMatches(MAN_PAGE_FILE, string(content))
+			},
+			Install: func() error {
+				content, err := os.ReadFile(manPage)
+				if err != nil {
+					return err
+				}
+				if err = writeHostFile(MAN_PAGE_FILE, string(content), 0644); err != nil {
+					return err
+				}
+				return runHost(`mandb`, `--quiet`)
+			},
+			Remove: func() error {
+				if _, err := os.Stat(MAN_PAGE_FILE); os.IsNotExist(err) {
+					return nil
+				}
+				if err := removeHostFile(MAN_PAGE_FILE); err != nil {
+					return err
+				}
+				return runHost(`mandb`, `--quiet`)
+			},
+		})
+	}
+	return items
+}
@@ -0,0 +1,305 @@
+package bcache
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SNAPSHOT_DIR = `/var/lib/bcachectl/snapshots/`
+
+// Writable attributes that trigger an action rather than hold a setting
+var SNAPSHOT_EXCLUDE = []string{
+	`attach`,
+	`detach`,
+	`stop`,
+	`unregister`,
+	`running`,
+	`clear_stats`,
+	`trigger_gc`,
+	`flash_vol_create`,
+	`prune_cache`,
+	// adjusted by the kernel while writeback_percent is set
+	`writeback_rate`,
+}
+
+// Saved settings of a cache set and its member cache devices (keyed cache0, cache1...)
+type CacheSetSnapshot struct {
+	Attributes DriveConfig            `yaml:"attributes"`
+	Members    map[string]DriveConfig `yaml:"members"`
+}
+
+// Saved writable attributes of all devices. Backing devices are keyed by their
+// backing device uuid, cache sets by their uuid.
+type Snapshot struct {
+	Name      string                      `yaml:"name"`
+	Time      time.Time                   `yaml:"time"`
+	Backing   map[string]DriveConfig      `yaml:"backing"`
+	CacheSets map[string]CacheSetSnapshot `yaml:"cache_sets"`
+}
+
+// A single difference between the current state and a snapshot
+type SnapshotChange struct {
+	Scope     string
+	Target    string
+	Attribute string
+	Path      string
+	Current   string
+	Saved     string
+}
+
+// Read the current value of every readable and writable setting in a sysfs dir, plus the
+// registry tunables of scope that live in its subdirs (eg. internal/gc_after_writeback)
+func writableAttrs(dir string, scope string) DriveConfig {
+	attrs := make(DriveConfig)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return attrs
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || contains(SNAPSHOT_EXCLUDE, entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.Mode().Perm()&0600 != 0600 {
+			continue
+		}
+		val := readVal(dir + `/` + entry.Name())
+		if val == "" || strings.Contains(val, "\n") {
+			continue
+		}
+		attrs[entry.Name()] = selectedVal(val)
+	}
+	for _, t := range TUNABLE_REGISTRY {
+		if t.Scope != scope || !strings.Contains(t.Path, "/") {
+			continue
+		}
+		info, err := os.Stat(dir + `/` + t.Path)
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0600 != 0600 {
+			continue
+		}
+		if val := readVal(dir + `/` + t.Path); val != "" && !strings.Contains(val, "\n") {
+			attrs[t.Path] = selectedVal(val)
+		}
+	}
+	return attrs
+}
+
+// Cache set uuids registered in sysfs
+func CacheSetUUIDs() (uuids []string) {
+	entries, _ := os.ReadDir(SYSFS_BCACHE_ROOT)
+	for _, j := range entries {
+		if j.IsDir() {
+			uuids = append(uuids, j.Name())
+		}
+	}
+	return
+}
+
+// Member cache dirs (cache0, cache1...) of a cache set
+func cacheSetMembers(uuid string) (members []string) {
+	entries, _ := os.ReadDir(SYSFS_BCACHE_ROOT + uuid)
+	re := regexp.MustCompile(`^cache[0-9]+$`)
+	for _, j := range entries {
+		if re.MatchString(j.Name()) {
+			members = append(members, j.Name())
+		}
+	}
+	return
+}
+
+// Capture the current settings of all backing devices, cache sets and cache devices
+func (b *BcacheDevs) TakeSnapshot(name string) *Snapshot {
+	s := &Snapshot{
+		Name:      name,
+		Time:      time.Now(),
+		Backing:   make(map[string]DriveConfig),
+		CacheSets: make(map[string]CacheSetSnapshot),
+	}
+	for _, bdev := range b.Bdevs {
+		s.Backing[bdev.BUUID] = writableAttrs(SYSFS_BLOCK_ROOT+bdev.ShortName+`/bcache`, SCOPE_BACKING)
+	}
+	for _, uuid := range CacheSetUUIDs() {
+		cs := CacheSetSnapshot{
+			Attributes: writableAttrs(SYSFS_BCACHE_ROOT+uuid, SCOPE_CACHE_SET),
+			Members:    make(map[string]DriveConfig),
+		}
+		for _, m := range cacheSetMembers(uuid) {
+			cs.Members[m] = writableAttrs(SYSFS_BCACHE_ROOT+uuid+`/`+m, SCOPE_CACHE)
+		}
+		s.CacheSets[uuid] = cs
+	}
+	return s
+}
+
+func snapshotPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", errors.New("invalid snapshot name: " + name)
+	}
+	return SNAPSHOT_DIR + name + `.yaml`, nil
+}
+
+func (s *Snapshot) Save() error {
+	path, err := snapshotPath(s.Name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(SNAPSHOT_DIR, 0750); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0640)
+}
+
+func LoadSnapshot(name string) (s *Snapshot, err error) {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return
+	}
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	s = new(Snapshot)
+	err = yaml.Unmarshal(f, s)
+	return
+}
+
+// Names of saved snapshots
+func ListSnapshots() (names []string, err error) {
+	entries, err := os.ReadDir(SNAPSHOT_DIR)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, j := range entries {
+		if strings.HasSuffix(j.Name(), `.yaml`) {
+			names = append(names, strings.TrimSuffix(j.Name(), `.yaml`))
+		}
+	}
+	return
+}
+
+// Order in which restored attributes are written within a backing device. Mode changes
+// come last, so the writeback settings are already in place when writeback starts.
+func restoreOrder(attr string) int {
+	switch attr {
+	case `cache_mode`:
+		return 2
+	case `writeback_running`:
+		return 3
+	}
+	return 1
+}
+
+func diffAttrs(scope string, target string, dir string, tunableScope string, saved DriveConfig, missing *[]string) (changes []SnapshotChange) {
+	if _, err := os.Stat(dir); err != nil {
+		*missing = append(*missing, scope+" "+target)
+		return
+	}
+	current := writableAttrs(dir, tunableScope)
+	var names []string
+	for attr := range saved {
+		names = append(names, attr)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if restoreOrder(names[i]) != restoreOrder(names[j]) {
+			return restoreOrder(names[i]) < restoreOrder(names[j])
+		}
+		return names[i] < names[j]
+	})
+	for _, attr := range names {
+		cur, ok := current[attr]
+		if !ok || TunableMatches(cur, saved[attr]) {
+			continue
+		}
+		changes = append(changes, SnapshotChange{
+			Scope:     scope,
+			Target:    target,
+			Attribute: attr,
+			Path:      dir + `/` + attr,
+			Current:   cur,
+			Saved:     saved[attr],
+		})
+	}
+	return
+}
+
+// Differences between the current state and the snapshot, in the order they should be
+// restored: cache sets, then cache devices, then backing devices. Devices in the snapshot
+// which are no longer registered are returned in missing.
+func (b *BcacheDevs) DiffSnapshot(s *Snapshot) (changes []SnapshotChange, missing []string) {
+	var uuids []string
+	for uuid := range s.CacheSets {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		changes = append(changes, diffAttrs("cache set", uuid, SYSFS_BCACHE_ROOT+uuid, SCOPE_CACHE_SET, s.CacheSets[uuid].Attributes, &missing)...)
+	}
+	for _, uuid := range uuids {
+		var members []string
+		for m := range s.CacheSets[uuid].Members {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		for _, m := range members {
+			changes = append(changes, diffAttrs("cache device", uuid+"/"+m, SYSFS_BCACHE_ROOT+uuid+`/`+m, SCOPE_CACHE, s.CacheSets[uuid].Members[m], &missing)...)
+		}
+	}
+	var buuids []string
+	for buuid := range s.Backing {
+		buuids = append(buuids, buuid)
+	}
+	sort.Strings(buuids)
+	for _, buuid := range buuids {
+		found := false
+		for _, bdev := range b.Bdevs {
+			if bdev.BUUID == buuid {
+				found = true
+				changes = append(changes, diffAttrs("backing", bdev.ShortName, SYSFS_BLOCK_ROOT+bdev.ShortName+`/bcache`, SCOPE_BACKING, s.Backing[buuid], &missing)...)
+			}
+		}
+		if !found {
+			missing = append(missing, "backing "+buuid)
+		}
+	}
+	return
+}
+
+// The registry tunable a saved attribute is, if any
+func (c SnapshotChange) tunable() (Tunable, bool) {
+	scope := c.Scope
+	if scope == "cache device" {
+		scope = SCOPE_CACHE
+	}
+	t, found := LookupTunable(c.Attribute)
+	if !found || t.Path != c.Attribute || t.Scope != scope {
+		return Tunable{}, false
+	}
+	return t, true
+}
+
+// Write the saved values of changes, stopping at the first error. Registry tunables are
+// converted like tune does (sizes to bytes or sectors), other attributes are written as saved.
+func RestoreSnapshot(changes []SnapshotChange) error {
+	for _, c := range changes {
+		val := c.Saved
+		if t, found := c.tunable(); found {
+			var err error
+			if val, err = t.Validate(val, c.Path); err != nil {
+				return errors.New("could not restore " + c.Attribute + " of " + c.Scope + " " + c.Target + ": " + err.Error())
+			}
+		}
+		if err := Exec.WriteFile(c.Path, val); err != nil {
+			return errors.New("could not restore " + c.Attribute + " of " + c.Scope + " " + c.Target + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+// What 'bcachectl stop' stops: backing devices first, then the cache set (if any)
+type StopTree struct {
+	CacheSet *Bcache_cdev
+	Bdevs    []Bcache_bdev
+}
+
+// Something that could not be stopped and why
+type Pinned struct {
+	Device string
+	Reason string
+}
+
+func (b *BcacheDevs) attachedTo(uuid string) (bdevs []Bcache_bdev) {
+	for _, bdev := range b.Bdevs {
+		if bdev.CUUID == uuid {
+			bdevs = append(bdevs, bdev)
+		}
+	}
+	return
+}
+
+// Work out what to stop for device (cache set uuid, cache device or backing device). A cache
+// set needs recursive when backing devices are attached, they are stopped before it. With
+// recursive the cache set of a backing device is stopped as well when no other backing
+// device is attached to it.
+func (b *BcacheDevs) PlanStop(device string, recursive bool) (t StopTree, err error) {
+	if x, cdev := b.IsCDevice(device); x {
+		t.CacheSet = &cdev
+		t.Bdevs = b.attachedTo(cdev.UUID)
+		if len(t.Bdevs) > 0 && !recursive {
+			var names []string
+			for _, bdev := range t.Bdevs {
+				names = append(names, bdev.ShortName)
+			}
+			return t, errors.New("cache set " + cdev.UUID + " still has backing devices attached (" + strings.Join(names, ", ") + "), use --recursive to stop them as well")
+		}
+		return
+	}
+	x, bdev := b.IsBDevice(device)
+	if !x {
+		return t, errors.New(device + " does not appear to be a registered bcache device.")
+	}
+	t.Bdevs = []Bcache_bdev{bdev}
+	if recursive && bdev.CUUID != NONE_ATTACHED && len(b.attachedTo(bdev.CUUID)) == 1 {
+		if x, cdev := b.IsCDevice(bdev.CUUID); x {
+			t.CacheSet = &cdev
+		}
+	}
+	return
+}
+
+// The tree as indented lines, eg.
+//
+//	cache set 5c0f... (/dev/nvme0n1p1)
+//	  bcache0 (/dev/sdb) writeback, dirty 1.2G
+//	    mounted on /srv (xfs) via bcache0
+func (t StopTree) Lines() (lines []string) {
+	indent := ""
+	if t.CacheSet != nil {
+		lines = append(lines, "cache set "+t.CacheSet.UUID+" ("+t.CacheSet.Dev+")")
+		indent = "  "
+	}
+	for _, bdev := range t.Bdevs {
+		line := indent + bdev.ShortName + " (" + bdev.BackingDev + ")"
+		if bdev.CUUID != NONE_ATTACHED {
+			line += " " + bdev.Val(`cache_mode`)
+			if bdev.Val(`state`) == `dirty` {
+				line += ", dirty " + bdev.Val(`dirty_data`)
+			}
+		}
+		lines = append(lines, line)
+		for _, u := range DeviceUsers(bdev.ShortName) {
+			lines = append(lines, indent+"  "+u.String())
+		}
+	}
+	return
+}
+
+// Why a backing device that was told to stop is still there
+func pinnedReason(bdev *Bcache_bdev) string {
+	if err := CheckNotInUse(bdev.ShortName); err != nil {
+		return err.Error()
+	}
+	return "still open by a process"
+}
+
+// Stop the tree in a safe order: backing devices in use (holders, mounts, swap) are left
+// alone unless force is set, dirty backing devices are flushed (opts) before they are
+// stopped, and the cache set is only stopped once all of its backing devices are gone.
+// Returns what could not be stopped and why, log is told about every device stopped.
+func (b *BcacheDevs) StopAll(ctx context.Context, t StopTree, force bool, opts FlushOptions, log func(string)) (pinned []Pinned) {
+	for i := range t.Bdevs {
+		bdev := &t.Bdevs[i]
+		if err := CheckNotInUse(bdev.ShortName); err != nil && !force {
+			pinned = append(pinned, Pinned{bdev.ShortName, err.Error() + ", not stopped"})
+			continue
+		}
+		if bdev.CUUID != NONE_ATTACHED && bdev.Val(`state`) == `dirty` {
+			flushErr, restoreErr := bdev.Flush(ctx, opts)
+			if flushErr != nil {
+				pinned = append(pinned, Pinned{bdev.ShortName, "could not flush: " + flushErr.Error()})
+				continue
+			}
+			if restoreErr != nil {
+				pinned = append(pinned, Pinned{bdev.ShortName, "flushed but could not reset its settings: " + restoreErr.Error()})
+				continue
+			}
+			log("flushed " + bdev.ShortName)
+		}
+		if err := b.Stop(bdev.ShortName); err != nil {
+			if _, statErr := os.Stat(SYSFS_BLOCK_ROOT + bdev.ShortName); statErr == nil {
+				pinned = append(pinned, Pinned{bdev.ShortName, pinnedReason(bdev)})
+			} else {
+				pinned = append(pinned, Pinned{bdev.ShortName, err.Error()})
+			}
+			continue
+		}
+		log("stopped " + bdev.ShortName + " (" + bdev.BackingDev + ")")
+	}
+	if t.CacheSet == nil {
+		return
+	}
+	if len(pinned) > 0 && !DryRun() {
+		pinned = append(pinned, Pinned{"cache set " + t.CacheSet.UUID, "backing devices could not be stopped, not stopped"})
+		return
+	}
+	if err := b.Stop(t.CacheSet.UUID); err != nil {
+		reason := err.Error()
+		if all, e := AllDevs(); e == nil {
+			var names []string
+			for _, bdev := range all.attachedTo(t.CacheSet.UUID) {
+				names = append(names, bdev.ShortName)
+			}
+			if len(names) > 0 {
+				reason = "backing devices still attached: " + strings.Join(names, ", ")
+			}
+		}
+		pinned = append(pinned, Pinned{"cache set " + t.CacheSet.UUID, reason})
+		return
+	}
+	log("stopped cache set " + t.CacheSet.UUID + " (" + t.CacheSet.Dev + ")")
+	return
+}
@@ -0,0 +1,219 @@
+package bcache
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A cache device as described in a topology file
+type TopologyCache struct {
+	Name   string `yaml:"name"`
+	Device string `yaml:"device"`
+	Wipe   bool   `yaml:"wipe"`
+}
+
+// A backing device as described in a topology file. Cache can be the name or device of
+// an entry in the caches section, or the uuid of an already registered cache set
+type TopologyBacking struct {
+	Device   string      `yaml:"device"`
+	Cache    string      `yaml:"cache"`
+	Label    string      `yaml:"label"`
+	Wipe     bool        `yaml:"wipe"`
+	Tunables DriveConfig `yaml:"tunables"`
+}
+
+// Desired layout of bcache devices on a host
+//
+// Example topology file:
+//
+//	tunables:
+//	  sequential_cutoff: 4M
+//	caches:
+//	  - name: ssd0
+//	    device: /dev/nvme0n1p1
+//	backing:
+//	  - device: /dev/sdb
+//	    cache: ssd0
+//	    label: osd-0
+//	    tunables:
+//	      cache_mode: writeback
+type Topology struct {
+	Tunables DriveConfig       `yaml:"tunables"`
+	Caches   []TopologyCache   `yaml:"caches"`
+	Backing  []TopologyBacking `yaml:"backing"`
+}
+
+// A single step required to bring the host in line with a topology
+type Step struct {
+	Description string
+	Do          func() error
+}
+
+func LoadTopology(topologyFile string) (t *Topology, err error) {
+	t = new(Topology)
+	f, err := os.ReadFile(topologyFile)
+	if err != nil {
+		return
+	}
+	err = yaml.UnmarshalStrict(f, t)
+	return
+}
+
+// Resolve symlinks such as /dev/disk/by-id/... to the kernel device name
+func resolveDev(dev string) string {
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+		return resolved
+	}
+	return dev
+}
+
+// Check if a device carries a bcache superblock, regardless of whether it is registered
+func IsFormatted(dev string) bool {
+	_, err := GetSuperBlock(dev)
+	return err == nil
+}
+
+// Step to get an unregistered device into a registered state, formatting it only when it
+// does not already carry a bcache superblock
+func prepareStep(dev string, cache bool, wipe bool) Step {
+	if IsFormatted(dev) {
+		return Step{
+			Description: "register " + dev,
+			Do: func() error {
+				return Register(dev)
+			},
+		}
+	}
+	kind := "backing"
+	if cache {
+		kind = "cache"
+	}
+	desc := "format " + dev + " as " + kind + " device"
+	if wipe {
+		desc += " (wiping existing superblocks)"
+	}
+	return Step{
+		Description: desc,
+		Do: func() error {
+			all, err := AllDevs()
+			if err != nil {
+				return err
+			}
+			if cache {
+				return all.Format("", dev, wipe, false)
+			}
+			return all.Format(dev, "", wipe, false)
+		},
+	}
+}
+
+// Compute the steps needed to make the current devices match topology t. Steps that are
+// already satisfied are left out, so an empty plan means there is nothing to do.
+func (b *BcacheDevs) PlanTopology(t *Topology) (steps []Step, err error) {
+	// cache name or device -> device
+	caches := make(map[string]string)
+	for _, c := range t.Caches {
+		if c.Device == "" {
+			return nil, errors.New("cache entry " + c.Name + " has no device")
+		}
+		dev := resolveDev(c.Device)
+		caches[c.Device] = dev
+		caches[dev] = dev
+		if c.Name != "" {
+			caches[c.Name] = dev
+		}
+		if x, _ := b.IsCDevice(dev); !x {
+			steps = append(steps, prepareStep(dev, true, c.Wipe))
+		}
+	}
+	for _, bk := range t.Backing {
+		if bk.Device == "" {
+			return nil, errors.New("backing entry has no device")
+		}
+		dev := resolveDev(bk.Device)
+		x, bdev := b.IsBDevice(dev)
+		if !x {
+			steps = append(steps, prepareStep(dev, false, bk.Wipe))
+		}
+		if bk.Cache != "" {
+			cdev := bk.Cache
+			if d, ok := caches[cdev]; ok {
+				cdev = d
+			}
+			attached := false
+			if x && bdev.CUUID != NONE_ATTACHED && bdev.CUUID != "" {
+				y, c := b.IsCDevice(cdev)
+				if (y && c.UUID == bdev.CUUID) || cdev == bdev.CUUID {
+					attached = true
+				} else {
+					return nil, errors.New(dev + " (" + bdev.ShortName + ") is attached to cache set " + bdev.CUUID + ", detach it before applying")
+				}
+			}
+			if !attached {
+				steps = append(steps, Step{
+					Description: "attach cache " + cdev + " to " + dev,
+					Do: func() error {
+						all, err := AllDevs()
+						if err != nil {
+							return err
+						}
+						return all.Attach(cdev, dev)
+					},
+				})
+			}
+		}
+		if bk.Label != "" && (!x || bdev.Label != bk.Label) {
+			label := bk.Label
+			steps = append(steps, Step{
+				Description: "set label of " + dev + " to " + label,
+				Do: func() error {
+					all, err := AllDevs()
+					if err != nil {
+						return err
+					}
+					z, err := all.LookupBDevice(dev)
+					if err != nil {
+						return err
+					}
+					return z.SetLabel(label)
+				},
+			})
+		}
+		tunables := make(DriveConfig)
+		for k, v := range t.Tunables {
+			tunables[k] = v
+		}
+		for k, v := range bk.Tunables {
+			tunables[k] = v
+		}
+		var names []string
+		for k := range tunables {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tunable := name + `:` + tunables[name]
+			if x && TunableMatches(bdev.Val(TunablePath(name)), tunables[name]) {
+				continue
+			}
+			steps = append(steps, Step{
+				Description: "tune " + dev + " " + tunable,
+				Do: func() error {
+					all, err := AllDevs()
+					if err != nil {
+						return err
+					}
+					z, err := all.LookupBDevice(dev)
+					if err != nil {
+						return err
+					}
+					return z.Tune(tunable)
+				},
+			})
+		}
+	}
+	return
+}
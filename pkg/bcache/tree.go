@@ -0,0 +1,126 @@
+package bcache
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Node types of the topology tree
+const (
+	NODE_CACHE_SET = "cache set"
+	NODE_CACHE     = "cache"
+	NODE_BCACHE    = "bcache"
+	NODE_BACKING   = "backing"
+)
+
+// A node of the topology tree. Children of a cache set are its cache devices and the bcache
+// devices attached to it, children of a bcache device are its backing device and whatever
+// uses it (holders, mounts, swap, see DeviceUser kinds).
+type TreeNode struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Detail   string      `json:"detail,omitempty"`
+	Children []*TreeNode `json:"children,omitempty"`
+}
+
+// Device of a cache set member (cache0, cache1...), the link points at <dev>/bcache
+func cacheMemberDev(uuid string, member string) string {
+	link, err := os.Readlink(SYSFS_BCACHE_ROOT + uuid + `/` + member)
+	if err != nil {
+		return member
+	}
+	link_a := strings.Split(link, "/")
+	if len(link_a) < 2 {
+		return member
+	}
+	return `/dev/` + link_a[len(link_a)-2]
+}
+
+func bcacheNode(bdev *Bcache_bdev) *TreeNode {
+	n := &TreeNode{Name: bdev.ShortName, Type: NODE_BCACHE}
+	if bdev.CUUID == NONE_ATTACHED {
+		n.Detail = NONE_ATTACHED
+	} else {
+		n.Detail = bdev.Val(`cache_mode`) + ", " + bdev.Val(`state`)
+		if bdev.Val(`state`) == `dirty` {
+			n.Detail += " " + bdev.Val(`dirty_data`)
+		}
+	}
+	if bdev.Label != "" {
+		n.Detail += ", label " + bdev.Label
+	}
+	n.Children = append(n.Children, &TreeNode{Name: bdev.BackingDev, Type: NODE_BACKING})
+	for _, u := range DeviceUsers(bdev.ShortName) {
+		child := &TreeNode{Name: u.Name, Type: u.Kind, Detail: u.Detail}
+		if u.Device != bdev.ShortName {
+			child.Detail = strings.TrimPrefix(child.Detail+", on "+u.Device, ", ")
+		}
+		n.Children = append(n.Children, child)
+	}
+	return n
+}
+
+// Cache sets with their cache devices and attached bcache devices, followed by the bcache
+// devices without a cache set as separate roots
+func (b *BcacheDevs) Tree() (roots []*TreeNode) {
+	cdevs := append([]Bcache_cdev(nil), b.Cdevs...)
+	sort.Slice(cdevs, func(i, j int) bool { return cdevs[i].Dev < cdevs[j].Dev })
+	for _, cdev := range cdevs {
+		set := &TreeNode{Name: cdev.UUID, Type: NODE_CACHE_SET}
+		for _, member := range cacheSetMembers(cdev.UUID) {
+			set.Children = append(set.Children, &TreeNode{Name: cacheMemberDev(cdev.UUID, member), Type: NODE_CACHE})
+		}
+		attached := b.attachedTo(cdev.UUID)
+		if len(attached) == 0 {
+			set.Detail = "idle"
+		}
+		for i := range attached {
+			set.Children = append(set.Children, bcacheNode(&attached[i]))
+		}
+		roots = append(roots, set)
+	}
+	for i := range b.Bdevs {
+		if b.Bdevs[i].CUUID == NONE_ATTACHED {
+			roots = append(roots, bcacheNode(&b.Bdevs[i]))
+		}
+	}
+	return
+}
+
+func (n *TreeNode) label() string {
+	s := n.Type + " " + n.Name
+	if n.Type == NODE_BCACHE {
+		s = n.Name
+	}
+	if n.Detail != "" {
+		s += " (" + n.Detail + ")"
+	}
+	return s
+}
+
+// Render the tree as text, eg.
+//
+//	cache set 5c0f...
+//	├─ cache /dev/nvme0n1p1
+//	└─ bcache0 (writeback, clean)
+//	   ├─ backing /dev/sdb
+//	   └─ mount /srv (xfs)
+func TreeLines(roots []*TreeNode) (lines []string) {
+	var walk func(n *TreeNode, prefix string)
+	walk = func(n *TreeNode, prefix string) {
+		for i, child := range n.Children {
+			branch, next := "├─ ", "│  "
+			if i == len(n.Children)-1 {
+				branch, next = "└─ ", "   "
+			}
+			lines = append(lines, prefix+branch+child.label())
+			walk(child, prefix+next)
+		}
+	}
+	for _, root := range roots {
+		lines = append(lines, root.label())
+		walk(root, "")
+	}
+	return
+}
@@ -0,0 +1,457 @@
+package bcache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where a tunable lives in sysfs
+const (
+	SCOPE_BACKING   = "backing"
+	SCOPE_CACHE_SET = "cache set"
+	SCOPE_CACHE     = "cache member"
+)
+
+// Kind of value a tunable takes
+const (
+	TYPE_ENUM  = "enum"
+	TYPE_BYTES = "bytes"
+	TYPE_INT   = "int"
+	TYPE_BOOL  = "bool"
+	// shown in bytes but written as 512 byte sectors
+	TYPE_SECTORS = "sectors"
+)
+
+// Description of a bcache tunable. Path is relative to the sysfs dir of its scope:
+// /sys/block/bcacheN/bcache/ for backing devices, /sys/fs/bcache/<cset uuid>/ for cache
+// sets and /sys/fs/bcache/<cset uuid>/cacheN/ for cache devices in a set.
+type Tunable struct {
+	Name  string
+	Path  string
+	Scope string
+	Type  string
+	Unit  string
+	// Inclusive range for int and bytes tunables, only checked when HasRange is set
+	Min      int64
+	Max      int64
+	HasRange bool
+	// Allowed values of enum tunables, used when they can't be read from sysfs
+	Values []string
+	// Set by the kernel and only shown, writing it fails
+	ReadOnly bool
+	// Adjusted by the kernel as it runs, so a saved value is stale as soon as it is read
+	AutoManaged bool
+	Default     string
+	Description string
+}
+
+var TUNABLE_REGISTRY = []Tunable{
+	{
+		Name:        `cache_mode`,
+		Path:        `cache_mode`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_ENUM,
+		Values:      []string{`writethrough`, `writeback`, `writearound`, `none`},
+		Default:     `writethrough`,
+		Description: `caching mode of the device`,
+	},
+	{
+		Name:        `sequential_cutoff`,
+		Path:        `sequential_cutoff`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BYTES,
+		Unit:        `bytes`,
+		Default:     `4194304`,
+		Description: `sequential IO larger than this bypasses the cache, 0 disables the cutoff`,
+	},
+	{
+		Name:        `writeback_delay`,
+		Path:        `writeback_delay`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Unit:        `seconds`,
+		Min:         0,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `30`,
+		Description: `when dirty data is written to an otherwise clean cache, wait this long before starting writeback`,
+	},
+	{
+		Name:        `writeback_percent`,
+		Path:        `writeback_percent`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Unit:        `percent`,
+		Min:         0,
+		Max:         40,
+		HasRange:    true,
+		Default:     `10`,
+		Description: `in writeback mode, bcache tries to keep this percentage of the cache dirty, 0 flushes the cache`,
+	},
+	{
+		Name:        `readahead_cache_policy`,
+		Path:        `readahead_cache_policy`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_ENUM,
+		Values:      []string{`all`, `meta-only`},
+		Default:     `all`,
+		Description: `whether readahead IO is cached (all) or only metadata readahead (meta-only)`,
+	},
+	{
+		Name:        `writeback_running`,
+		Path:        `writeback_running`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BOOL,
+		Default:     `1`,
+		Description: `whether background writeback of dirty data is running, 0 pauses writeback`,
+	},
+	{
+		Name:        `writeback_metadata`,
+		Path:        `writeback_metadata`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BOOL,
+		Default:     `1`,
+		Description: `whether metadata (REQ_META) writes are cached in writeback mode`,
+	},
+	{
+		Name:        `writeback_rate`,
+		Path:        `writeback_rate`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_SECTORS,
+		Unit:        `bytes/second`,
+		Min:         1,
+		Max:         2147483647,
+		HasRange:    true,
+		AutoManaged: true,
+		Default:     `4096`,
+		Description: `rate at which dirty data is written back, adjusted automatically while writeback_percent is non zero`,
+	},
+	{
+		Name:        `writeback_rate_minimum`,
+		Path:        `writeback_rate_minimum`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Unit:        `sectors/second`,
+		Min:         1,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `8`,
+		Description: `lower limit of the automatically adjusted writeback rate`,
+	},
+	{
+		Name:        `writeback_rate_update_seconds`,
+		Path:        `writeback_rate_update_seconds`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Unit:        `seconds`,
+		Min:         1,
+		Max:         60,
+		HasRange:    true,
+		Default:     `5`,
+		Description: `interval at which the writeback rate is recalculated`,
+	},
+	{
+		Name:        `writeback_rate_p_term_inverse`,
+		Path:        `writeback_rate_p_term_inverse`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Min:         1,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `40`,
+		Description: `inverse of the proportional term of the writeback rate controller, lower reacts faster`,
+	},
+	{
+		Name:        `writeback_rate_i_term_inverse`,
+		Path:        `writeback_rate_i_term_inverse`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_INT,
+		Min:         1,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `10000`,
+		Description: `inverse of the integral term of the writeback rate controller, lower reacts faster`,
+	},
+	{
+		Name:        `sequential_merge`,
+		Path:        `sequential_merge`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BOOL,
+		Default:     `1`,
+		Description: `whether sequential IO from different requests is tracked together for the sequential cutoff`,
+	},
+	{
+		Name:        `readahead`,
+		Path:        `readahead`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BYTES,
+		Unit:        `bytes`,
+		Default:     `0`,
+		Description: `on a cache miss, also read this much more from the backing device into the cache`,
+	},
+	{
+		Name:        `stop_when_cache_set_failed`,
+		Path:        `stop_when_cache_set_failed`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_ENUM,
+		Values:      []string{`auto`, `always`},
+		Default:     `auto`,
+		Description: `stop the device when its cache set fails, auto only stops it if it has dirty data`,
+	},
+	{
+		Name:        `partial_stripes_expensive`,
+		Path:        `partial_stripes_expensive`,
+		Scope:       SCOPE_BACKING,
+		Type:        TYPE_BOOL,
+		ReadOnly:    true,
+		Default:     `0`,
+		Description: `whether partial stripe writes are expensive on the backing device (eg. raid5/6), so writeback prefers full stripes`,
+	},
+	{
+		Name:        `congested_read_threshold_us`,
+		Path:        `congested_read_threshold_us`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_INT,
+		Unit:        `microseconds`,
+		Min:         0,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `2000`,
+		Description: `reads bypass the cache when cache read latency exceeds this, 0 disables congestion tracking`,
+	},
+	{
+		Name:        `congested_write_threshold_us`,
+		Path:        `congested_write_threshold_us`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_INT,
+		Unit:        `microseconds`,
+		Min:         0,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `20000`,
+		Description: `writes bypass the cache when cache write latency exceeds this, 0 disables congestion tracking`,
+	},
+	{
+		Name:        `journal_delay_ms`,
+		Path:        `journal_delay_ms`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_INT,
+		Unit:        `milliseconds`,
+		Min:         0,
+		Max:         65535,
+		HasRange:    true,
+		Default:     `100`,
+		Description: `how long journal writes are delayed to batch them together`,
+	},
+	{
+		Name:        `synchronous`,
+		Path:        `synchronous`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_BOOL,
+		Default:     `0`,
+		Description: `whether writes wait for the journal, so cache contents survive a crash consistently at a cost in write latency`,
+	},
+	{
+		Name:        `errors`,
+		Path:        `errors`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_ENUM,
+		Values:      []string{`unregister`, `panic`},
+		Default:     `unregister`,
+		Description: `what to do when the cache set hits an IO error limit or metadata error`,
+	},
+	{
+		Name:        `io_error_limit`,
+		Path:        `io_error_limit`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_INT,
+		Min:         0,
+		Max:         4294967295,
+		HasRange:    true,
+		Default:     `8`,
+		Description: `number of IO errors after which the cache set is disabled, errors decay over io_error_halflife`,
+	},
+	{
+		Name:        `gc_after_writeback`,
+		Path:        `internal/gc_after_writeback`,
+		Scope:       SCOPE_CACHE_SET,
+		Type:        TYPE_BOOL,
+		Default:     `0`,
+		Description: `run garbage collection once writeback has finished, to free buckets sooner`,
+	},
+	{
+		Name:        `cache_replacement_policy`,
+		Path:        `cache_replacement_policy`,
+		Scope:       SCOPE_CACHE,
+		Type:        TYPE_ENUM,
+		Values:      []string{`lru`, `fifo`, `random`},
+		Default:     `lru`,
+		Description: `policy used to choose which buckets are reused`,
+	},
+	{
+		Name:        `discard`,
+		Path:        `discard`,
+		Scope:       SCOPE_CACHE,
+		Type:        TYPE_BOOL,
+		Default:     `0`,
+		Description: `issue discards for buckets before they are reused`,
+	},
+}
+
+// Tunable paths relative to the bcache dir of a backing device, cache set and cache
+// tunables are reached through the 'cache' link to the attached set
+var TUNABLES = backingRelativePaths()
+
+var TUNABLE_DESCRIPTIONS = describeTunables()
+
+func backingRelativePaths() (paths []string) {
+	for _, t := range TUNABLE_REGISTRY {
+		paths = append(paths, t.BackingPath())
+	}
+	return
+}
+
+func describeTunables() (desc string) {
+	for _, t := range TUNABLE_REGISTRY {
+		desc += "\n" + t.Name + ":<" + strings.ToUpper(t.Type) + ">  " + t.Description
+		if t.Type == TYPE_ENUM {
+			desc += ", possible values " + strings.Join(t.Values, ", ")
+		}
+		desc += ", default " + t.Default + " (" + t.Scope + ")"
+		if t.ReadOnly {
+			desc += ", read-only"
+		}
+	}
+	return
+}
+
+// Find a tunable by name
+func LookupTunable(name string) (t Tunable, found bool) {
+	for _, t = range TUNABLE_REGISTRY {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tunable{}, false
+}
+
+// Path of the tunable relative to the bcache dir of a backing device
+func (t Tunable) BackingPath() string {
+	switch t.Scope {
+	case SCOPE_CACHE_SET:
+		return `cache/` + t.Path
+	case SCOPE_CACHE:
+		return `cache/cache0/` + t.Path
+	}
+	return t.Path
+}
+
+// Full sysfs path of the tunable, with placeholders for the device or cache set
+func (t Tunable) SysfsPath() string {
+	switch t.Scope {
+	case SCOPE_CACHE_SET:
+		return SYSFS_BCACHE_ROOT + `<cset uuid>/` + t.Path
+	case SCOPE_CACHE:
+		return SYSFS_BCACHE_ROOT + `<cset uuid>/cacheN/` + t.Path
+	}
+	return SYSFS_BLOCK_ROOT + `bcacheN/bcache/` + t.Path
+}
+
+// Allowed values of an enum tunable, read from the bracketed list in sysfs (eg.
+// "writethrough [writeback] writearound none") when path exists
+func (t Tunable) AllowedValues(path string) []string {
+	if path != "" {
+		if raw := readVal(path); strings.Contains(raw, `[`) {
+			var values []string
+			for _, v := range strings.Fields(raw) {
+				values = append(values, strings.Trim(v, `[]`))
+			}
+			return values
+		}
+	}
+	return t.Values
+}
+
+// Human readable range or allowed values
+func (t Tunable) Range(path string) string {
+	switch t.Type {
+	case TYPE_ENUM:
+		return strings.Join(t.AllowedValues(path), ", ")
+	case TYPE_BOOL:
+		return "0, 1"
+	}
+	if t.HasRange && t.Type == TYPE_SECTORS {
+		return BytesToHuman(uint64(t.Min)*512) + " - " + BytesToHuman(uint64(t.Max)*512)
+	}
+	if t.HasRange {
+		return fmt.Sprintf("%d - %d", t.Min, t.Max)
+	}
+	return "any"
+}
+
+// Check val against the tunable and return the value to write to sysfs. Sizes such as 4M
+// are converted to bytes. path is the sysfs file of the tunable, used to read allowed
+// enum values, and may be empty.
+func (t Tunable) Validate(val string, path string) (string, error) {
+	if t.ReadOnly {
+		return "", errors.New(t.Name + " is read-only, it is set by the kernel")
+	}
+	orig := val
+	switch t.Type {
+	case TYPE_ENUM:
+		if !contains(t.AllowedValues(path), val) {
+			return "", errors.New("invalid value '" + val + "' for " + t.Name + ", possible values: " + t.Range(path))
+		}
+		return val, nil
+	case TYPE_BOOL:
+		if val != "0" && val != "1" {
+			return "", errors.New("invalid value '" + val + "' for " + t.Name + ", expecting 0 or 1")
+		}
+		return val, nil
+	case TYPE_BYTES:
+		val = HumanToBytes(val)
+	case TYPE_SECTORS:
+		if bytes, err := strconv.ParseInt(HumanToBytes(val), 10, 64); err == nil {
+			val = strconv.FormatInt((bytes+511)/512, 10)
+		}
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid value '" + orig + "' for " + t.Name + ", expecting a number")
+	}
+	if t.HasRange && (n < t.Min || n > t.Max) {
+		return "", errors.New("value " + orig + " for " + t.Name + " is out of range (" + t.Range(path) + ")")
+	}
+	return val, nil
+}
+
+// Sysfs path of the tunable on the first registered device or cache set it applies to,
+// empty if there is none
+func (t Tunable) FirstPath(b *BcacheDevs) string {
+	var candidates []string
+	switch t.Scope {
+	case SCOPE_BACKING:
+		for _, bdev := range b.Bdevs {
+			candidates = append(candidates, SYSFS_BLOCK_ROOT+bdev.ShortName+`/bcache/`+t.Path)
+		}
+	case SCOPE_CACHE_SET:
+		for _, uuid := range CacheSetUUIDs() {
+			candidates = append(candidates, SYSFS_BCACHE_ROOT+uuid+`/`+t.Path)
+		}
+	case SCOPE_CACHE:
+		for _, uuid := range CacheSetUUIDs() {
+			for _, m := range cacheSetMembers(uuid) {
+				candidates = append(candidates, SYSFS_BCACHE_ROOT+uuid+`/`+m+`/`+t.Path)
+			}
+		}
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
@@ -1,46 +1,117 @@
 package bcache
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"math"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
-var TUNABLE_DESCRIPTIONS = `
-sequential_cutoff:<INT>  threshold for a sequential IO to bypass the cache, set using byte value, default 4.0M (4194304)"
-readahead:<INT>  size of readahead that should be performed, set using byte value, default 0
-writeback_percent:<INT> bcache tries to keep this amount of percentage of dirty data for writeback mode, a setting of 0 would flush the cache
-cache_mode:<STR> cache mode to use, possible values writethrough, writeback, writearound, none`
-
 type DriveConfig map[string]string
 
+// Contents of a tuning config file. Top level sections are 'all' or a backing device
+// uuid, cache set sections are under 'cache_sets' and keyed by 'all' or a cache set uuid.
+type TuneConfig struct {
+	Devices   map[string]DriveConfig
+	CacheSets map[string]DriveConfig
+}
+
 // Defaults
-func NewDriveConfig() map[string]DriveConfig {
-	var cfg map[string]DriveConfig = map[string]DriveConfig{
-		`all`: DriveConfig{
-			`sequential_cutoff`: `4194304`,
-			`writeback_percent`: `10`,
+func NewTuneConfig() *TuneConfig {
+	return &TuneConfig{
+		Devices: map[string]DriveConfig{
+			`all`: DriveConfig{
+				`sequential_cutoff`: `4194304`,
+				`writeback_percent`: `10`,
+			},
 		},
+		CacheSets: make(map[string]DriveConfig),
 	}
-	return cfg
 }
 
-func Parse(d *map[string]DriveConfig, configFile string) (err error) {
+func (c *TuneConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sections map[string]yaml.MapSlice
+	if err := unmarshal(&sections); err != nil {
+		return err
+	}
+	var sets struct {
+		CacheSets map[string]DriveConfig `yaml:"cache_sets"`
+	}
+	if err := unmarshal(&sets); err != nil {
+		return err
+	}
+	if c.Devices == nil {
+		c.Devices = make(map[string]DriveConfig)
+	}
+	if c.CacheSets == nil {
+		c.CacheSets = make(map[string]DriveConfig)
+	}
+	for name, section := range sections {
+		if name == `cache_sets` {
+			continue
+		}
+		c.Devices[name] = make(DriveConfig)
+		for _, item := range section {
+			c.Devices[name][fmt.Sprint(item.Key)] = fmt.Sprint(item.Value)
+		}
+	}
+	for name, section := range sets.CacheSets {
+		c.CacheSets[name] = section
+	}
+	return nil
+}
+
+// Device sections are written first, sorted, followed by the cache_sets section
+func (c *TuneConfig) MarshalYAML() (interface{}, error) {
+	var names []string
+	for name := range c.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out yaml.MapSlice
+	for _, name := range names {
+		out = append(out, yaml.MapItem{Key: name, Value: c.Devices[name]})
+	}
+	if len(c.CacheSets) > 0 {
+		out = append(out, yaml.MapItem{Key: `cache_sets`, Value: c.CacheSets})
+	}
+	return out, nil
+}
+
+// Same layout as the yaml config file
+func (c *TuneConfig) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{})
+	for name, section := range c.Devices {
+		out[name] = section
+	}
+	if len(c.CacheSets) > 0 {
+		out[`cache_sets`] = c.CacheSets
+	}
+	return json.Marshal(out)
+}
+
+func Parse(cfg *TuneConfig, configFile string) (err error) {
 	f, err := os.ReadFile(configFile)
 	if err != nil {
 		return
 	}
-	err = yaml.Unmarshal(f, d)
+	err = yaml.Unmarshal(f, cfg)
 	if err != nil {
 		return
 	}
 	return
 }
 
+// Sizes are shown in human readable form by bcache (eg. 4.0M)
+var humanSize = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kMGT]$`)
+
 // Convert string to bytes string, eg. "1.0k" to "1024"
 func HumanToBytes(s string) (bytesVal string) {
 	var l, n []rune
@@ -65,45 +136,150 @@ func HumanToBytes(s string) (bytesVal string) {
 		bytesVal = fmt.Sprintf("%d", int(value_float*1024*1024))
 	} else if strings.Contains(units, "g") || strings.Contains(units, "G") {
 		bytesVal = fmt.Sprintf("%d", int(value_float*1024*1024*1024))
+	} else if strings.Contains(units, "t") || strings.Contains(units, "T") {
+		bytesVal = fmt.Sprintf("%d", int(value_float*1024*1024*1024*1024))
 	} else if units == "" {
 		bytesVal = fmt.Sprintf("%d", int(value_float))
 	}
 	return
 }
 
-// Example config file to use this func with, use cache set uuid to override 'all'
-// or default config
+// Convert a byte count to a human readable string, eg. 1536 to "1.5k"
+func BytesToHuman(b uint64) string {
+	units := []string{"", "k", "M", "G", "T", "P"}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v = v / 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d", b)
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
+// Example config file to use this func with. Sections are applied in layers: 'all',
+// then selector sections (see Selector), then the backing device uuid section, each
+// overriding settings of the previous layers. Cache set tunables go under 'cache_sets',
+// where a cache set uuid section is applied on top of 'all'.
 // all:
 //
 //	sequential_cutoff: 16384
 //
-// cf85e0c3-cb0a-4c99-a003-b629adb0be0b:
+// label:db*:
 //
-//	sequential_cutoff: 8192
+//	cache_mode: writeback
 //
 // 577e54bb-23d3-4ef3-b5f4-749d3124ed0f:
 //
 //	sequential_cutoff: 4096
 //	writeback_percent: 20
+//
+// cache_sets:
+//
+//	all:
+//	  congested_read_threshold_us: 0
+//	f0f1ec08-b474-4dd5-932d-d93baa95b62f:
+//	  journal_delay_ms: 50
 func (b *BcacheDevs) TuneFromFile(configFile string) (err error) {
-	cfg := NewDriveConfig()
-	err = Parse(&cfg, configFile)
+	cfg := NewTuneConfig()
+	err = Parse(cfg, configFile)
 	if err != nil {
 		return
 	}
-	for _, bdev := range b.Bdevs {
-		if cfg[bdev.BUUID] != nil {
-			for tunable, val := range cfg[bdev.BUUID] {
-				err = bdev.Tune(tunable + `:` + val)
-				if err != nil {
-					return
-				}
+	// resolve every device before changing anything, mode selectors match the current mode
+	settings := make([][]EffectiveSetting, len(b.Bdevs))
+	for i := range b.Bdevs {
+		settings[i], err = cfg.Resolve(&b.Bdevs[i])
+		if err != nil {
+			return
+		}
+	}
+	for i, bdev := range b.Bdevs {
+		for _, s := range settings[i] {
+			err = bdev.Tune(s.Tunable + `:` + s.Value)
+			if err != nil {
+				return
+			}
+		}
+	}
+	for _, cdev := range b.Cdevs {
+		var settings []EffectiveSetting
+		settings, err = cfg.ResolveCacheSet(cdev.UUID)
+		if err != nil {
+			return
+		}
+		for _, s := range settings {
+			err = cdev.Tune(s.Tunable + `:` + s.Value)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// A tunable whose live value differs from the value a config file wants
+type ConfigDrift struct {
+	Scope   string `json:"scope"`
+	Target  string `json:"target"`
+	Tunable string `json:"tunable"`
+	Path    string `json:"path"`
+	Current string `json:"current"`
+	Desired string `json:"desired"`
+	Section string `json:"section"`
+}
+
+func driftOf(scope string, target string, t Tunable, s EffectiveSetting, path string) (ConfigDrift, bool) {
+	current := ReadSysfs(path)
+	if t.AutoManaged || TunableMatches(current, s.Value) {
+		return ConfigDrift{}, false
+	}
+	return ConfigDrift{
+		Scope:   scope,
+		Target:  target,
+		Tunable: t.Name,
+		Path:    path,
+		Current: current,
+		Desired: s.Value,
+		Section: s.Section,
+	}, true
+}
+
+// Compare the effective settings of a config file with the live values of every
+// registered backing device and cache set
+func (b *BcacheDevs) DiffConfig(cfg *TuneConfig) (drift []ConfigDrift, err error) {
+	for i, bdev := range b.Bdevs {
+		settings, err := cfg.Resolve(&b.Bdevs[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			t, found := LookupTunable(s.Tunable)
+			if !found {
+				return nil, errors.New("tunable not in allowed list: " + s.Tunable)
+			}
+			path := SYSFS_BLOCK_ROOT + bdev.ShortName + `/bcache/` + t.BackingPath()
+			if d, drifted := driftOf(SCOPE_BACKING, bdev.ShortName, t, s, path); drifted {
+				drift = append(drift, d)
 			}
-		} else {
-			for tunable, val := range cfg["all"] {
-				err = bdev.Tune(tunable + `:` + val)
-				if err != nil {
-					return
+		}
+	}
+	for _, cdev := range b.Cdevs {
+		settings, err := cfg.ResolveCacheSet(cdev.UUID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			t, found := LookupTunable(s.Tunable)
+			if !found {
+				return nil, errors.New("tunable not in allowed list: " + s.Tunable)
+			}
+			for _, path := range cdev.TunablePaths(t) {
+				target := strings.TrimSuffix(strings.TrimPrefix(path, SYSFS_BCACHE_ROOT), `/`+t.Path)
+				if d, drifted := driftOf(t.Scope, target, t, s, path); drifted {
+					drift = append(drift, d)
 				}
 			}
 		}
@@ -111,23 +287,100 @@ func (b *BcacheDevs) TuneFromFile(configFile string) (err error) {
 	return
 }
 
-func (b *Bcache_bdev) Tune(tunable string) error {
-	tunable_a := strings.Split(tunable, ":")
-	if len(tunable_a[0]) == 0 || len(tunable_a[1]) == 0 {
-		return errors.New("tunable string not properly formatted: " + tunable)
+// Split a "name:value" tunable string
+func splitTunable(tunable string) (name string, val string, err error) {
+	tunable_a := strings.SplitN(tunable, ":", 2)
+	if len(tunable_a) != 2 || len(tunable_a[0]) == 0 || len(tunable_a[1]) == 0 {
+		return "", "", errors.New("tunable string not properly formatted: " + tunable)
 	}
+	return tunable_a[0], tunable_a[1], nil
+}
 
-	var valToSet string
-	if tunable_a[0] == "sequential_cutoff" || tunable_a[0] == "readahead" ||
-		tunable_a[0] == "writeback_rate" {
-		valToSet = HumanToBytes(tunable_a[1])
-	} else {
-		valToSet = tunable_a[1]
+func (b *Bcache_bdev) Tune(tunable string) error {
+	name, val, err := splitTunable(tunable)
+	if err != nil {
+		return err
+	}
+	t, found := LookupTunable(name)
+	if !found {
+		return errors.New("tunable not in allowed list: " + name)
+	}
+	p := t.BackingPath()
+	valToSet, err := t.Validate(val, SYSFS_BLOCK_ROOT+b.ShortName+`/bcache/`+p)
+	if err != nil {
+		return err
 	}
-	p := TunablePath(tunable_a[0])
 	return b.ChangeTunable(p, valToSet)
 }
 
+// Sysfs paths of a cache set or cache member tunable in this cache set, cache member
+// tunables have one path per cache device in the set
+func (c *Bcache_cdev) TunablePaths(t Tunable) (paths []string) {
+	switch t.Scope {
+	case SCOPE_CACHE_SET:
+		paths = append(paths, SYSFS_BCACHE_ROOT+c.UUID+`/`+t.Path)
+	case SCOPE_CACHE:
+		for _, m := range cacheSetMembers(c.UUID) {
+			paths = append(paths, SYSFS_BCACHE_ROOT+c.UUID+`/`+m+`/`+t.Path)
+		}
+	}
+	return
+}
+
+// Tune a cache set, eg. "journal_delay_ms:100". Cache member tunables are applied to
+// every cache device in the set.
+func (c *Bcache_cdev) Tune(tunable string) error {
+	name, val, err := splitTunable(tunable)
+	if err != nil {
+		return err
+	}
+	t, found := LookupTunable(name)
+	if !found {
+		return errors.New("tunable not in allowed list: " + name)
+	}
+	if t.Scope == SCOPE_BACKING {
+		return errors.New(name + " is a backing device tunable, tune the bcache device instead of the cache set")
+	}
+	paths := c.TunablePaths(t)
+	if len(paths) == 0 {
+		return errors.New("cache set " + c.UUID + " has no cache devices")
+	}
+	for _, path := range paths {
+		valToSet, err := t.Validate(val, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return errors.New("tunable path does not exist: " + path)
+		}
+		if err = Exec.WriteFile(path, valToSet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compare a current tunable value read from sysfs with a desired value. Sizes are reported
+// by bcache in rounded human readable form (eg. 976.5k), so byte values are allowed to differ
+// by less than 0.1%
+func TunableMatches(current string, desired string) bool {
+	if current == desired {
+		return true
+	}
+	if current == "" || desired == "" || !unicode.IsDigit(rune(current[0])) || !unicode.IsDigit(rune(desired[0])) {
+		return false
+	}
+	c, err := strconv.ParseFloat(HumanToBytes(current), 64)
+	if err != nil {
+		return false
+	}
+	d, err := strconv.ParseFloat(HumanToBytes(desired), 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(c-d) <= d/1000
+}
+
 func contains(a []string, s string) bool {
 	for _, x := range a {
 		if s == x {
@@ -139,10 +392,8 @@ func contains(a []string, s string) bool {
 
 // return relative tunable path from bcache device sysfs
 func TunablePath(tunable string) (path string) {
-	for _, path = range TUNABLES {
-		if strings.Contains(path, tunable) {
-			return
-		}
+	if t, found := LookupTunable(tunable); found {
+		return t.BackingPath()
 	}
 	return tunable
 }
@@ -163,21 +414,43 @@ func (b *Bcache_bdev) ChangeTunable(tunable string, val string) error {
 		return errors.New("tunable not in allowed list: " + tunable)
 	}
 	b.MakeParameters(TUNABLES)
-	if _, err := os.Stat(write_path); err != nil {
+	if _, err := os.Stat(write_path); err != nil && !DryRun() {
 		return errors.New("tunable path does not exist: " + write_path)
 	}
-	return ioutil.WriteFile(write_path, []byte(val), 0)
+	return Exec.WriteFile(write_path, val)
 }
 
-// return map of current tunables
-func (b *BcacheDevs) GetTunables() map[string]DriveConfig {
-	output := make(map[string]DriveConfig)
+// return current tunables of all backing devices and cache sets, leaving out read-only
+// and kernel managed ones which can't be restored
+func (b *BcacheDevs) GetTunables() *TuneConfig {
+	output := &TuneConfig{
+		Devices:   make(map[string]DriveConfig),
+		CacheSets: make(map[string]DriveConfig),
+	}
 	for _, bdev := range b.Bdevs {
-		output[bdev.BUUID] = make(DriveConfig)
-		for _, tunable := range TUNABLES {
-			value := bdev.Val(tunable)
+		output.Devices[bdev.BUUID] = make(DriveConfig)
+		for _, t := range TUNABLE_REGISTRY {
+			if t.Scope != SCOPE_BACKING || t.ReadOnly || t.AutoManaged {
+				continue
+			}
+			value := bdev.Val(t.Path)
 			if value != "" {
-				output[bdev.BUUID][BaseName(tunable)] = value
+				output.Devices[bdev.BUUID][t.Name] = value
+			}
+		}
+	}
+	for _, cdev := range b.Cdevs {
+		output.CacheSets[cdev.UUID] = make(DriveConfig)
+		for _, t := range TUNABLE_REGISTRY {
+			if t.ReadOnly || t.AutoManaged {
+				continue
+			}
+			// cache member tunables are shown as set by the first member
+			if paths := cdev.TunablePaths(t); len(paths) > 0 {
+				value := ReadSysfs(paths[0])
+				if value != "" {
+					output.CacheSets[cdev.UUID][t.Name] = value
+				}
 			}
 		}
 	}
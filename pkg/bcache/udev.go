@@ -0,0 +1,56 @@
+package bcache
+
+import (
+	"errors"
+	"os"
+)
+
+const DEFAULT_CONFIG = `/etc/bcachectl.conf`
+const UDEV_RULES_FILE = `/etc/udev/rules.d/69-bcachectl.rules`
+
+// udev rule running 'bcachectl udev-apply' for every bcache device that is added
+func UdevRule(bcachectl string, configFile string) string {
+	run := bcachectl + ` udev-apply %k`
+	if configFile != DEFAULT_CONFIG {
+		run = run + ` --config ` + configFile
+	}
+	return "# Generated by bcachectl, tunes bcache devices from " + configFile + " when they appear\n" +
+		`ACTION=="add", SUBSYSTEM=="block", KERNEL=="bcache[0-9]*", RUN+="` + run + "\"\n"
+}
+
+// Write the udev rule to rulesFile and reload the udev rules
+func InstallUdevRule(rulesFile string, bcachectl string, configFile string) error {
+	err := Exec.Change(Action{Path: rulesFile, Value: "udev rule for " + bcachectl}, func() error {
+		return os.WriteFile(rulesFile, []byte(UdevRule(bcachectl, configFile)), 0644)
+	})
+	if err != nil {
+		return err
+	}
+	if out, err := Exec.RunArgs(`udevadm`, `control`, `--reload`); err != nil {
+		return errors.New("could not reload udev rules: " + out + err.Error())
+	}
+	return nil
+}
+
+// Apply the settings of a config file that match a single backing device, eg. when it is
+// registered after the config was applied at boot
+func (b *BcacheDevs) TuneDeviceFromFile(configFile string, device string) error {
+	x, bdev := b.IsBDevice(device)
+	if !x {
+		return errors.New(device + " does not appear to be a valid bcache device")
+	}
+	cfg := NewTuneConfig()
+	if err := Parse(cfg, configFile); err != nil {
+		return err
+	}
+	settings, err := cfg.Resolve(&bdev)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if err = bdev.Tune(s.Tunable + `:` + s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
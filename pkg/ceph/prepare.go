@@ -0,0 +1,353 @@
+package ceph
+
+import (
+	"errors"
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs ceph-volume, can be replaced to test preparation without a ceph cluster
+type VolumeRunner interface {
+	Run(args ...string) (out string, err error)
+}
+
+// Runs the real ceph-volume binary
+type CephVolume struct {
+	Path string
+}
+
+func (c CephVolume) Run(args ...string) (out string, err error) {
+	path := c.Path
+	if path == "" {
+		path = "ceph-volume"
+	}
+	out, err = bcache.Exec.RunArgs(path, args...)
+	if err != nil {
+		err = errors.New(strings.TrimSpace(out) + " " + err.Error())
+	}
+	return
+}
+
+// Settings for preparing one or more OSDs
+type OSDConfig struct {
+	DataDevices []string
+	CacheDevice string
+	CacheSize   string
+	DBDevice    string
+	DBSize      string
+	WALDevice   string
+	WALSize     string
+	CacheMode   string
+	SeqCutoff   string
+	Reuse       bool
+	CVArgs      []string
+}
+
+func NewOSDConfig() OSDConfig {
+	return OSDConfig{
+		CacheMode: "writethrough",
+		SeqCutoff: "8k",
+	}
+}
+
+// Plans OSD preparation: bcache on the data device with a cache partition, optional
+// db and wal partitions and finally `ceph-volume lvm create`
+type Preparer struct {
+	Config OSDConfig
+	Runner VolumeRunner
+	// partition tables of cache/db/wal disks, shared by all data devices
+	tables  map[string]*bcache.GptTable
+	created map[string][]bcache.GptPartition
+}
+
+func NewPreparer(cfg OSDConfig, runner VolumeRunner) *Preparer {
+	return &Preparer{Config: cfg, Runner: runner}
+}
+
+// Where whole disks are listed and how registered bcache devices are found, replaced by tests
+var blockRoot = bcache.SYSFS_BLOCK_ROOT
+var allDevs = bcache.AllDevs
+
+// Partitions on the cache, db and wal devices must be created on whole disks. Returns the
+// disk with symlinks (eg. /dev/disk/by-id/...) resolved, partitions are named after it.
+func checkWholeDisk(dev string, what string) (string, error) {
+	disk := dev
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		disk = real
+	}
+	if _, err := os.Stat(blockRoot + filepath.Base(disk)); err != nil {
+		return "", errors.New(dev + " is not an acceptable " + what + " device (physical disk that can be partitioned). Is it a partition?")
+	}
+	return disk, nil
+}
+
+func parseSize(size string, what string) (uint64, error) {
+	n, err := strconv.ParseUint(bcache.HumanToBytes(size), 10, 64)
+	if err != nil || n == 0 {
+		return 0, errors.New("a valid --" + what + "-size is required with --" + what + "-device")
+	}
+	return n, nil
+}
+
+func (p *Preparer) table(dev string) (t *bcache.GptTable, err error) {
+	if t = p.tables[dev]; t != nil {
+		return
+	}
+	if t, err = bcache.ReadGPT(dev, false); err != nil {
+		return
+	}
+	p.tables[dev] = t
+	return
+}
+
+// Find or plan the partition labelled <data>_<suffix> on disk. Returns the partition device
+// and whether it already existed
+func (p *Preparer) partition(disk string, data string, suffix string, size uint64) (dev string, existing bool, err error) {
+	t, err := p.table(disk)
+	if err != nil {
+		return
+	}
+	label := filepath.Base(data) + "_" + suffix
+	if found, part := t.FindByName(label); found {
+		for _, c := range p.created[disk] {
+			if c.Number == part.Number {
+				return t.PartitionDev(part.Number), false, nil
+			}
+		}
+		if !p.Config.Reuse {
+			return "", true, errors.New("there already is a " + suffix + " partition for " + filepath.Base(data) + " (" + t.PartitionDev(part.Number) + "), use --reuse to reuse it")
+		}
+		return t.PartitionDev(part.Number), true, nil
+	}
+	part, err := t.AddPartition(label, size)
+	if err != nil {
+		return
+	}
+	p.created[disk] = append(p.created[disk], part)
+	return t.PartitionDev(part.Number), false, nil
+}
+
+func waitUnregistered(dev string) error {
+	if bcache.DryRun() {
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		all, err := allDevs()
+		if err != nil {
+			return err
+		}
+		if x, _ := all.IsCDevice(dev); !x {
+			return nil
+		}
+		time.Sleep(time.Second * 1)
+	}
+	return errors.New(dev + " is still registered as a cache device")
+}
+
+func (p *Preparer) runStep(desc string, args ...string) bcache.Step {
+	return bcache.Step{
+		Description: desc + ": ceph-volume " + strings.Join(args, " "),
+		Do: func() error {
+			_, err := p.Runner.Run(args...)
+			return err
+		},
+	}
+}
+
+// Check the configuration and work out every step needed to prepare the OSDs. Nothing
+// is changed on the host until the steps are run.
+func (p *Preparer) Plan() (steps []bcache.Step, err error) {
+	cfg := p.Config
+	p.tables = make(map[string]*bcache.GptTable)
+	p.created = make(map[string][]bcache.GptPartition)
+	if len(cfg.DataDevices) == 0 {
+		return nil, errors.New("at least one data device is required")
+	}
+	var cacheSize, dbSize, walSize uint64
+	if cfg.CacheDevice != "" {
+		if cfg.CacheDevice, err = checkWholeDisk(cfg.CacheDevice, "cache"); err != nil {
+			return
+		}
+		if cacheSize, err = parseSize(cfg.CacheSize, "cache"); err != nil {
+			return
+		}
+	}
+	if cfg.DBDevice != "" {
+		if cfg.DBDevice, err = checkWholeDisk(cfg.DBDevice, "db"); err != nil {
+			return
+		}
+		if dbSize, err = parseSize(cfg.DBSize, "db"); err != nil {
+			return
+		}
+	}
+	if cfg.WALDevice != "" {
+		if cfg.WALDevice, err = checkWholeDisk(cfg.WALDevice, "wal"); err != nil {
+			return
+		}
+		if walSize, err = parseSize(cfg.WALSize, "wal"); err != nil {
+			return
+		}
+	}
+	all, err := allDevs()
+	if err != nil {
+		return
+	}
+	var osdSteps []bcache.Step
+	for _, data := range cfg.DataDevices {
+		if _, err = os.Stat(data); err != nil {
+			return nil, errors.New("the data device " + data + " does not exist")
+		}
+		real, _ := filepath.EvalSymlinks(data)
+		if real == cfg.CacheDevice || real == cfg.DBDevice || real == cfg.WALDevice {
+			return nil, errors.New("the data device " + data + " can't also be used as cache, db or wal device")
+		}
+		if x, _ := all.IsBDevice(data); x {
+			return nil, errors.New(data + " is already a bcache device")
+		}
+		data := data
+		osdData := func() (string, error) { return data, nil }
+		if cfg.CacheDevice != "" {
+			cacheDev, existing, err := p.partition(cfg.CacheDevice, data, "cache", cacheSize)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, bcache.Step{
+				Description: "format " + data + " as backing device",
+				Do: func() error {
+					all, err := allDevs()
+					if err != nil {
+						return err
+					}
+					return all.Format(data, "", false, false)
+				},
+			})
+			if existing {
+				if x, _ := all.IsCDevice(cacheDev); x {
+					steps = append(steps, bcache.Step{
+						Description: "unregister existing cache " + cacheDev,
+						Do: func() error {
+							all, err := allDevs()
+							if err != nil {
+								return err
+							}
+							if err = all.UnregisterCache(cacheDev); err != nil {
+								return err
+							}
+							return waitUnregistered(cacheDev)
+						},
+					})
+				}
+			}
+			osdSteps = append(osdSteps, bcache.Step{
+				Description: "format " + cacheDev + " as cache device and attach it to " + data,
+				Do: func() error {
+					all, err := allDevs()
+					if err != nil {
+						return err
+					}
+					if err = all.Format("", cacheDev, true, false); err != nil {
+						return err
+					}
+					if all, err = allDevs(); err != nil {
+						return err
+					}
+					return all.Attach(cacheDev, data)
+				},
+			})
+			for _, tunable := range []string{"cache_mode:" + cfg.CacheMode, "sequential_cutoff:" + cfg.SeqCutoff} {
+				tunable := tunable
+				osdSteps = append(osdSteps, bcache.Step{
+					Description: "tune " + data + " " + tunable,
+					Do: func() error {
+						all, err := allDevs()
+						if err != nil {
+							return err
+						}
+						b, err := all.LookupBDevice(data)
+						if err != nil {
+							return err
+						}
+						return b.Tune(tunable)
+					},
+				})
+			}
+			osdData = func() (string, error) {
+				all, err := allDevs()
+				if err != nil {
+					return "", err
+				}
+				b, err := all.LookupBDevice(data)
+				if err != nil {
+					return "", err
+				}
+				return b.BcacheDev, nil
+			}
+		}
+		create := []string{"lvm", "create"}
+		create = append(create, cfg.CVArgs...)
+		for _, extra := range []struct {
+			disk   string
+			suffix string
+			flag   string
+			size   uint64
+		}{
+			{cfg.DBDevice, "db", "--block.db", dbSize},
+			{cfg.WALDevice, "wal", "--block.wal", walSize},
+		} {
+			if extra.disk == "" {
+				continue
+			}
+			dev, existing, err := p.partition(extra.disk, data, extra.suffix, extra.size)
+			if err != nil {
+				return nil, err
+			}
+			if existing {
+				osdSteps = append(osdSteps, p.runStep("zap existing "+extra.suffix+" partition", "lvm", "zap", dev))
+			}
+			create = append(create, extra.flag, dev)
+		}
+		desc := "create OSD on " + data
+		if cfg.CacheDevice != "" {
+			desc += " (bcache device)"
+		}
+		osdSteps = append(osdSteps, bcache.Step{
+			Description: desc + ": ceph-volume " + strings.Join(create, " ") + " --data <" + data + ">",
+			Do: func() error {
+				dev, err := osdData()
+				if err != nil {
+					return err
+				}
+				_, err = p.Runner.Run(append(create, "--data", dev)...)
+				return err
+			},
+		})
+	}
+	// all partitions of a disk are written in one go, before anything uses them
+	var disks []string
+	for disk := range p.created {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	var partSteps []bcache.Step
+	for _, disk := range disks {
+		t, created := p.tables[disk], p.created[disk]
+		var names []string
+		for _, c := range created {
+			names = append(names, c.Name+" ("+t.PartitionDev(c.Number)+", "+bcache.BytesToHuman(t.PartitionSize(c))+")")
+		}
+		partSteps = append(partSteps, bcache.Step{
+			Description: "create partitions on " + disk + ": " + strings.Join(names, ", "),
+			Do: func() error {
+				return t.Commit(created)
+			},
+		})
+	}
+	steps = append(steps, partSteps...)
+	steps = append(steps, osdSteps...)
+	return
+}
@@ -0,0 +1,187 @@
+package ceph
+
+import (
+	"github.com/rafalop/bcachectl/pkg/bcache"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Records every ceph-volume invocation instead of running it
+type fakeVolume struct {
+	calls [][]string
+}
+
+func (f *fakeVolume) Run(args ...string) (string, error) {
+	f.calls = append(f.calls, args)
+	return "", nil
+}
+
+// A fake host: sparse files as disks, listed as whole disks in a fake /sys/block, and no
+// registered bcache devices
+func fakeHost(t *testing.T, disks ...string) string {
+	dir := t.TempDir()
+	oldRoot, oldAllDevs := blockRoot, allDevs
+	t.Cleanup(func() { blockRoot, allDevs = oldRoot, oldAllDevs })
+	blockRoot = filepath.Join(dir, "sys") + "/"
+	allDevs = func() (*bcache.BcacheDevs, error) { return new(bcache.BcacheDevs), nil }
+	for _, disk := range disks {
+		f, err := os.Create(filepath.Join(dir, disk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Truncate(256 << 20); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err = os.MkdirAll(blockRoot+disk, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func descriptions(steps []bcache.Step) (descs []string) {
+	for _, s := range steps {
+		descs = append(descs, s.Description)
+	}
+	return
+}
+
+func TestPlanSteps(t *testing.T) {
+	dir := fakeHost(t, "sdb", "nvme0n1", "sdc", "sdd")
+	cfg := NewOSDConfig()
+	cfg.DataDevices = []string{dir + "/sdb"}
+	cfg.CacheDevice, cfg.CacheSize = dir+"/nvme0n1", "16M"
+	cfg.DBDevice, cfg.DBSize = dir+"/sdc", "8M"
+	cfg.WALDevice, cfg.WALSize = dir+"/sdd", "4M"
+	steps, err := NewPreparer(cfg, &fakeVolume{}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"format " + dir + "/sdb as backing device",
+		"create partitions on " + dir + "/nvme0n1: sdb_cache (" + dir + "/nvme0n1p1, 16.0M)",
+		"create partitions on " + dir + "/sdc: sdb_db (" + dir + "/sdc1, 8.0M)",
+		"create partitions on " + dir + "/sdd: sdb_wal (" + dir + "/sdd1, 4.0M)",
+		"format " + dir + "/nvme0n1p1 as cache device and attach it to " + dir + "/sdb",
+		"tune " + dir + "/sdb cache_mode:writethrough",
+		"tune " + dir + "/sdb sequential_cutoff:8k",
+		"create OSD on " + dir + "/sdb (bcache device): ceph-volume lvm create --block.db " + dir + "/sdc1 --block.wal " + dir + "/sdd1 --data <" + dir + "/sdb>",
+	}
+	if got := descriptions(steps); !reflect.DeepEqual(got, want) {
+		t.Errorf("steps\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestPlanSharesDisks(t *testing.T) {
+	dir := fakeHost(t, "sdb", "sdc", "nvme0n1")
+	cfg := NewOSDConfig()
+	cfg.DataDevices = []string{dir + "/sdb", dir + "/sdc"}
+	cfg.DBDevice, cfg.DBSize = dir+"/nvme0n1", "8M"
+	steps, err := NewPreparer(cfg, &fakeVolume{}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"create partitions on " + dir + "/nvme0n1: sdb_db (" + dir + "/nvme0n1p1, 8.0M), sdc_db (" + dir + "/nvme0n1p2, 8.0M)",
+		"create OSD on " + dir + "/sdb: ceph-volume lvm create --block.db " + dir + "/nvme0n1p1 --data <" + dir + "/sdb>",
+		"create OSD on " + dir + "/sdc: ceph-volume lvm create --block.db " + dir + "/nvme0n1p2 --data <" + dir + "/sdc>",
+	}
+	if got := descriptions(steps); !reflect.DeepEqual(got, want) {
+		t.Errorf("steps\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestPlanReuse(t *testing.T) {
+	dir := fakeHost(t, "sdb", "sdc")
+	table, err := bcache.ReadGPT(dir+"/sdc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddPartition("sdb_db", 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Write(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewOSDConfig()
+	cfg.DataDevices = []string{dir + "/sdb"}
+	cfg.DBDevice, cfg.DBSize = dir+"/sdc", "8M"
+	if _, err = NewPreparer(cfg, &fakeVolume{}).Plan(); err == nil || !strings.Contains(err.Error(), "use --reuse") {
+		t.Fatalf("expected an error asking for --reuse, got %v", err)
+	}
+	cfg.Reuse = true
+	steps, err := NewPreparer(cfg, &fakeVolume{}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"zap existing db partition: ceph-volume lvm zap " + dir + "/sdc1",
+		"create OSD on " + dir + "/sdb: ceph-volume lvm create --block.db " + dir + "/sdc1 --data <" + dir + "/sdb>",
+	}
+	if got := descriptions(steps); !reflect.DeepEqual(got, want) {
+		t.Errorf("steps\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestPlanCephVolumeArgs(t *testing.T) {
+	dir := fakeHost(t, "sdb", "sdc", "sdd")
+	table, err := bcache.ReadGPT(dir+"/sdc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddPartition("sdb_db", 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Write(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewOSDConfig()
+	cfg.DataDevices = []string{dir + "/sdb"}
+	cfg.DBDevice, cfg.DBSize = dir+"/sdc", "8M"
+	cfg.WALDevice, cfg.WALSize = dir+"/sdd", "4M"
+	cfg.Reuse = true
+	cfg.CVArgs = []string{"--osd-id=88", "--crush-device-class=foo"}
+	runner := &fakeVolume{}
+	steps, err := NewPreparer(cfg, runner).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// partitions can't be added to the kernel for plain files, only run ceph-volume
+	for _, s := range steps {
+		if !strings.Contains(s.Description, "ceph-volume") {
+			continue
+		}
+		if err = s.Do(); err != nil {
+			t.Fatalf("%s: %v", s.Description, err)
+		}
+	}
+	want := [][]string{
+		{"lvm", "zap", dir + "/sdc1"},
+		{"lvm", "create", "--osd-id=88", "--crush-device-class=foo", "--block.db", dir + "/sdc1", "--block.wal", dir + "/sdd1", "--data", dir + "/sdb"},
+	}
+	if !reflect.DeepEqual(runner.calls, want) {
+		t.Errorf("ceph-volume calls\n got: %q\nwant: %q", runner.calls, want)
+	}
+}
+
+func TestCheckWholeDisk(t *testing.T) {
+	dir := fakeHost(t, "sdb")
+	byID := filepath.Join(dir, "ata-DISK_1234")
+	if err := os.Symlink(filepath.Join(dir, "sdb"), byID); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := checkWholeDisk(byID, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk != filepath.Join(dir, "sdb") {
+		t.Errorf("expected the link to resolve to %s, got %s", filepath.Join(dir, "sdb"), disk)
+	}
+	if _, err = checkWholeDisk(filepath.Join(dir, "sdb1"), "db"); err == nil {
+		t.Error("expected a partition to be refused")
+	}
+}